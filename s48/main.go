@@ -0,0 +1,273 @@
+// S48: A record-aware demultiplexer, the inverse of a round robin reader.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     partition #0
+//     fr	Paris	2229621
+//     fr	Marseille	855393
+//     partition #1
+//     partition #2
+//     de	Berlin	3520031
+//     it	Rome	2872800
+//     de	Hamburg	1787408
+//     de	Munich	1450381
+//     it	Milan	1366180
+//     it	Florence	382258
+//     copy: <nil>
+//     flush: demux: destination #1: disk full
+//     good destination: 800 of 1600 records, err: <nil>
+//     "a.txt\x00c.txt\x00" "with\nnewline.txt\x00"
+//     "" "1,x;2,x;3,x"
+//
+// Which partition a key ends up in depends on the hash, but all records with the
+// same key always go to the same partition.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+var s = `de	Berlin	3520031
+it	Rome	2872800
+fr	Paris	2229621
+de	Hamburg	1787408
+de	Munich	1450381
+it	Milan	1366180
+fr	Marseille	855393
+it	Florence	382258
+`
+
+// KeyFunc maps a record to the index of one of n writers. The record is passed
+// without its delimiter and, for newline delimited records, without a
+// trailing carriage return.
+type KeyFunc func(record []byte, n int) int
+
+// HashKey shards records by a hash of the whole record.
+func HashKey(record []byte, n int) int {
+	h := fnv.New32a()
+	h.Write(record)
+	return int(h.Sum32() % uint32(n))
+}
+
+// FieldKey shards records by a hash of the i-th field, fields are separated by sep.
+// Records with fewer fields are treated as having an empty key.
+func FieldKey(sep byte, i int) KeyFunc {
+	return func(record []byte, n int) int {
+		fields := bytes.Split(record, []byte{sep})
+		if i >= len(fields) {
+			return HashKey(nil, n)
+		}
+		return HashKey(fields[i], n)
+	}
+}
+
+// RoundRobinKey distributes records evenly, one after another.
+func RoundRobinKey() KeyFunc {
+	var cur int
+	return func(record []byte, n int) int {
+		i := cur % n
+		cur++
+		return i
+	}
+}
+
+// DestError records, which destination failed.
+type DestError struct {
+	Index int
+	Err   error
+}
+
+func (e *DestError) Error() string {
+	return fmt.Sprintf("demux: destination #%d: %v", e.Index, e.Err)
+}
+
+func (e *DestError) Unwrap() error { return e.Err }
+
+// dest is a single buffered destination, that keeps its first error around.
+type dest struct {
+	w   *bufio.Writer
+	err error
+}
+
+// Demux splits a stream of delimited records and writes each record to one of
+// several writers. It does not split records, so every destination receives
+// only complete records.
+type Demux struct {
+	ds    []*dest
+	key   KeyFunc
+	delim byte
+	buf   []byte // incomplete record, waiting for more data
+}
+
+// NewDemux creates a new demultiplexer for newline delimited records.
+func NewDemux(key KeyFunc, ws ...io.Writer) *Demux {
+	return NewDemuxDelim('\n', key, ws...)
+}
+
+// NewDemuxDelim creates a new demultiplexer for records ending with delim,
+// e.g. a NUL byte for the output of find -print0.
+func NewDemuxDelim(delim byte, key KeyFunc, ws ...io.Writer) *Demux {
+	d := &Demux{key: key, delim: delim}
+	for _, w := range ws {
+		d.ds = append(d.ds, &dest{w: bufio.NewWriter(w)})
+	}
+	return d
+}
+
+// Write routes each complete record in p to a destination. An incomplete
+// trailing record is kept until the next Write or Flush. If the chosen
+// destination has failed, the record is dropped, but Write carries on, so
+// other destinations are not affected by a single failing writer. Failed
+// destinations are reported by Flush and Err.
+func (d *Demux) Write(p []byte) (n int, err error) {
+	if len(d.ds) == 0 {
+		return 0, fmt.Errorf("demux: no destinations")
+	}
+	n = len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, d.delim)
+		if i < 0 {
+			d.buf = append(d.buf, p...)
+			break
+		}
+		var record []byte
+		if len(d.buf) > 0 {
+			d.buf = append(d.buf, p[:i+1]...)
+			record, d.buf = d.buf, d.buf[:0]
+		} else {
+			record = p[:i+1]
+		}
+		p = p[i+1:]
+		if werr := d.route(record); werr != nil && err == nil {
+			if _, ok := werr.(*DestError); !ok {
+				err = werr
+			}
+		}
+	}
+	return n, err
+}
+
+// route writes a single record to the destination chosen by the key function.
+func (d *Demux) route(record []byte) error {
+	i := d.key(d.trim(record), len(d.ds))
+	if i < 0 || i >= len(d.ds) {
+		return fmt.Errorf("demux: key function returned %d for %d destinations", i, len(d.ds))
+	}
+	dst := d.ds[i]
+	if dst.err != nil {
+		return &DestError{Index: i, Err: dst.err}
+	}
+	if _, err := dst.w.Write(record); err != nil {
+		dst.err = err
+		return &DestError{Index: i, Err: err}
+	}
+	return nil
+}
+
+// trim removes the delimiter and, if the delimiter is a newline, a carriage
+// return before it.
+func (d *Demux) trim(record []byte) []byte {
+	if n := len(record); n > 0 && record[n-1] == d.delim {
+		record = record[:n-1]
+		if n := len(record); d.delim == '\n' && n > 0 && record[n-1] == '\r' {
+			record = record[:n-1]
+		}
+	}
+	return record
+}
+
+// Err returns the error of the i-th destination, if any.
+func (d *Demux) Err(i int) error {
+	return d.ds[i].err
+}
+
+// Flush routes a pending, not delimited record and flushes all destinations.
+// It returns the first error encountered.
+func (d *Demux) Flush() error {
+	var err error
+	if len(d.buf) > 0 {
+		err = d.route(d.buf)
+		d.buf = d.buf[:0]
+	}
+	for i, dst := range d.ds {
+		if dst.err != nil {
+			if err == nil {
+				err = &DestError{Index: i, Err: dst.err}
+			}
+			continue
+		}
+		if ferr := dst.w.Flush(); ferr != nil {
+			dst.err = ferr
+			if err == nil {
+				err = &DestError{Index: i, Err: ferr}
+			}
+		}
+	}
+	return err
+}
+
+// failWriter fails on every write, like a full disk.
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+func main() {
+	// Shard a TSV by its first column into three partitions. Use os.Create here
+	// to shard into files instead.
+	var parts [3]bytes.Buffer
+	d := NewDemux(FieldKey('\t', 0), &parts[0], &parts[1], &parts[2])
+	if _, err := io.Copy(d, strings.NewReader(s)); err != nil {
+		log.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	for i := range parts {
+		fmt.Printf("partition #%d\n", i)
+		if _, err := parts[i].WriteTo(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// A failing destination does not stop the split.
+	var good bytes.Buffer
+	d = NewDemux(RoundRobinKey(), &good, failWriter{})
+	input := strings.Repeat(s, 200)
+	_, err := io.Copy(d, strings.NewReader(input))
+	fmt.Printf("copy: %v\n", err)
+	fmt.Printf("flush: %v\n", d.Flush())
+	fmt.Printf("good destination: %d of %d records, err: %v\n",
+		strings.Count(good.String(), "\n"), strings.Count(input, "\n"), d.Err(0))
+
+	// Records ending with a NUL byte, as written by find -print0.
+	var a, b bytes.Buffer
+	d = NewDemuxDelim(0, RoundRobinKey(), &a, &b)
+	if _, err := io.WriteString(d, "a.txt\x00with\nnewline.txt\x00c.txt\x00"); err != nil {
+		log.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%q %q\n", a.String(), b.String())
+
+	// The delimiter is not part of the key, so all records have the same key,
+	// the unterminated last one, too.
+	a.Reset()
+	b.Reset()
+	d = NewDemuxDelim(';', FieldKey(',', 1), &a, &b)
+	io.WriteString(d, "1,x;2,x;3,x")
+	if err := d.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%q %q\n", a.String(), b.String())
+}
@@ -0,0 +1,246 @@
+// S49: A ring buffer, answering the questions from S30.
+//
+// OUTPUT:
+//
+//     $ echo -n "Hello Buffer" | go run main.go
+//     2017/03/04 13:48:22 12 bytes read
+//     Hello Buffer
+//
+// The buffer reuses memory of bytes it already handed out. Compare it to a
+// bytes.Buffer in a producer/consumer setting, where 4KB chunks are written and
+// read in turn and a backlog of unread data never drains:
+//
+//     $ go run main.go -bench
+//     2017/03/04 13:48:22 ring.Buffer  backlog    1000  8613268    129.3 ns/op  31680.54 MB/s    0 B/op    0 allocs/op
+//     2017/03/04 13:48:22 bytes.Buffer backlog    1000 12453957    119.5 ns/op  34288.30 MB/s    0 B/op    0 allocs/op
+//     2017/03/04 13:48:22 ring.Buffer  backlog 1048576  4401517    244.9 ns/op  16723.64 MB/s    0 B/op    0 allocs/op
+//     2017/03/04 13:48:22 bytes.Buffer backlog 1048576  2640547    451.2 ns/op   9077.81 MB/s    1 B/op    0 allocs/op
+//
+// Neither buffer allocates once it has grown: bytes.Buffer slides its unread
+// bytes to the front, instead of growing. With a small backlog, that is cheap
+// and both perform the same. With a backlog of 1MB, bytes.Buffer moves the
+// whole backlog again and again, while the ring buffer never copies unread
+// bytes, and is almost twice as fast. Numbers will vary with the machine.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+// minRead is the smallest free space we make room for in ReadFrom, as in bytes.Buffer.
+const minRead = 512
+
+// Buffer is a growable ring buffer. Unlike the buffer in S30, it reclaims the
+// space of bytes that have been read, so a buffer that is drained as fast as it
+// is filled never needs to allocate again.
+type Buffer struct {
+	b   []byte // capacity is zero or a power of two
+	off int    // read position
+	n   int    // number of unread bytes
+}
+
+// Len returns the number of unread bytes.
+func (b *Buffer) Len() int {
+	return b.n
+}
+
+// Cap returns the current capacity of this buffer.
+func (b *Buffer) Cap() int {
+	return len(b.b)
+}
+
+// Reset empties the buffer, but keeps the allocated memory.
+func (b *Buffer) Reset() {
+	b.off, b.n = 0, 0
+}
+
+// Grow makes room for at least n more bytes, so the next n bytes can be
+// written without another allocation.
+func (b *Buffer) Grow(n int) {
+	if n < 0 {
+		panic("ring: negative count")
+	}
+	if len(b.b)-b.n >= n {
+		return
+	}
+	c := len(b.b)
+	if c == 0 {
+		c = 64
+	}
+	for c < b.n+n {
+		c *= 2
+	}
+	nb := make([]byte, c)
+	b.copyTo(nb)
+	b.b, b.off = nb, 0
+}
+
+// copyTo copies the unread bytes into p, which must be large enough.
+func (b *Buffer) copyTo(p []byte) {
+	k := copy(p, b.b[b.off:b.end()])
+	copy(p[k:], b.b[:b.n-k])
+}
+
+// end returns the end of the first contiguous chunk of unread bytes.
+func (b *Buffer) end() int {
+	if e := b.off + b.n; e < len(b.b) {
+		return e
+	}
+	return len(b.b)
+}
+
+// free returns the first contiguous chunk of free space.
+func (b *Buffer) free() []byte {
+	w := (b.off + b.n) & (len(b.b) - 1)
+	if b.off+b.n >= len(b.b) {
+		return b.b[w:b.off]
+	}
+	return b.b[w:]
+}
+
+// consume marks k bytes as read.
+func (b *Buffer) consume(k int) {
+	b.off = (b.off + k) & (len(b.b) - 1)
+	b.n -= k
+	if b.n == 0 {
+		b.off = 0
+	}
+}
+
+// Write appends p to the buffer, growing it as needed.
+func (b *Buffer) Write(p []byte) (n int, err error) {
+	b.Grow(len(p))
+	for n < len(p) {
+		k := copy(b.free(), p[n:])
+		b.n += k
+		n += k
+	}
+	return n, nil
+}
+
+// Read reads up to len(p) bytes. It returns io.EOF only if the buffer is empty,
+// never together with data.
+func (b *Buffer) Read(p []byte) (n int, err error) {
+	if b.n == 0 {
+		b.Reset()
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	for n < len(p) && b.n > 0 {
+		k := copy(p[n:], b.b[b.off:b.end()])
+		b.consume(k)
+		n += k
+	}
+	return n, nil
+}
+
+// ReadFrom reads from r until EOF directly into the free space of the buffer.
+func (b *Buffer) ReadFrom(r io.Reader) (n int64, err error) {
+	for {
+		if len(b.b)-b.n < minRead {
+			b.Grow(minRead)
+		}
+		k, err := r.Read(b.free())
+		if k < 0 {
+			panic("ring: reader returned negative count from Read")
+		}
+		b.n += k
+		n += int64(k)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// WriteTo writes the unread bytes to w until the buffer is drained or an error occurs.
+func (b *Buffer) WriteTo(w io.Writer) (n int64, err error) {
+	for b.n > 0 {
+		k, err := w.Write(b.b[b.off:b.end()])
+		b.consume(k)
+		n += int64(k)
+		if err != nil {
+			return n, err
+		}
+		if k == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// Bytes returns the unread bytes. The slice is only valid until the next
+// modification of the buffer. If the bytes wrap around the end of the ring,
+// they are rotated in place first, which does not allocate.
+func (b *Buffer) Bytes() []byte {
+	if b.off+b.n > len(b.b) {
+		reverse(b.b[:b.off])
+		reverse(b.b[b.off:])
+		reverse(b.b)
+		b.off = 0
+	}
+	return b.b[b.off : b.off+b.n]
+}
+
+// reverse reverses a byte slice in place.
+func reverse(p []byte) {
+	for i, j := 0, len(p)-1; i < j; i, j = i+1, j-1 {
+		p[i], p[j] = p[j], p[i]
+	}
+}
+
+// produceConsume writes and reads chunks in turn, with a new buffer from
+// newBuf. The buffer is filled with a backlog in advance, so it never runs
+// empty.
+func produceConsume(newBuf func() io.ReadWriter, backlog int) func(b *testing.B) {
+	return func(b *testing.B) {
+		rw := newBuf()
+		p := make([]byte, 4096)
+		rw.Write(make([]byte, backlog))
+		b.SetBytes(int64(len(p)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			rw.Write(p)
+			io.ReadFull(rw, p)
+		}
+	}
+}
+
+func main() {
+	bench := flag.Bool("bench", false, "compare with bytes.Buffer")
+	flag.Parse()
+
+	if *bench {
+		for _, backlog := range []int{1000, 1 << 20} {
+			r := testing.Benchmark(produceConsume(func() io.ReadWriter { return &Buffer{} }, backlog))
+			log.Printf("ring.Buffer  backlog %7d %s %s", backlog, r, r.MemString())
+			r = testing.Benchmark(produceConsume(func() io.ReadWriter { return &bytes.Buffer{} }, backlog))
+			log.Printf("bytes.Buffer backlog %7d %s %s", backlog, r, r.MemString())
+		}
+		return
+	}
+
+	var buf Buffer
+	if _, err := io.Copy(&buf, os.Stdin); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%d bytes read", buf.Len())
+	b, err := ioutil.ReadAll(&buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(b))
+}
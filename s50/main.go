@@ -0,0 +1,317 @@
+// S50: A pipe with a fixed size buffer.
+//
+// Like io.Pipe, but a write only blocks if the internal buffer is full, and a
+// read only blocks, if the buffer is empty. Producer and consumer do not need
+// to meet on every single write.
+//
+// OUTPUT:
+//
+//     $ go run -race main.go
+//     2017/03/04 13:48:22 producer #0: 10000 lines
+//     2017/03/04 13:48:22 producer #1: 10000 lines
+//     2017/03/04 13:48:22 producer #2: 10000 lines
+//     2017/03/04 13:48:22 producer #3: 10000 lines
+//     2017/03/04 13:48:22 consumer closed the pipe early: enough
+//     2017/03/04 13:48:22 consumer #0 read 30256 bytes
+//     2017/03/04 13:48:22 consumer #1 read 38208 bytes
+//     2017/03/04 13:48:22 consumer #2 read 31552 bytes
+//     2017/03/04 13:48:22 blocked write woken up: 4 bytes, enough
+//
+// How many bytes each consumer gets varies from run to run, but no consumer is
+// starved: the example fails, if a consumer gets less than a fifth of a fair
+// share.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pipe is the shared state of a PipeReader and PipeWriter.
+type pipe struct {
+	rmu sync.Mutex // serializes reads
+	wmu sync.Mutex // serializes writes, so a single write is never interleaved
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	b        []byte // fixed size ring
+	off, n   int    // read position and number of buffered bytes
+	rerr     error  // set, when the reader is closed
+	werr     error  // set, when the writer is closed
+}
+
+func (p *pipe) read(b []byte) (n int, err error) {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.n == 0 {
+		if p.rerr != nil {
+			return 0, io.ErrClosedPipe
+		}
+		if p.werr != nil {
+			return 0, p.werr
+		}
+		if len(b) == 0 {
+			return 0, nil
+		}
+		p.notEmpty.Wait()
+	}
+	if p.rerr != nil {
+		return 0, io.ErrClosedPipe
+	}
+	for n < len(b) && p.n > 0 {
+		end := p.off + p.n
+		if end > len(p.b) {
+			end = len(p.b)
+		}
+		k := copy(b[n:], p.b[p.off:end])
+		p.off = (p.off + k) % len(p.b)
+		p.n -= k
+		n += k
+	}
+	p.notFull.Broadcast()
+	return n, nil
+}
+
+func (p *pipe) write(b []byte) (n int, err error) {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for n < len(b) {
+		if p.werr != nil {
+			return n, io.ErrClosedPipe
+		}
+		if p.rerr != nil {
+			return n, p.rerr
+		}
+		if p.n == len(p.b) {
+			p.notFull.Wait()
+			continue
+		}
+		w := (p.off + p.n) % len(p.b)
+		end := p.off
+		if w >= p.off {
+			end = len(p.b)
+		}
+		k := copy(p.b[w:end], b[n:])
+		p.n += k
+		n += k
+		p.notEmpty.Broadcast()
+	}
+	return n, nil
+}
+
+func (p *pipe) closeRead(err error) {
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rerr == nil {
+		p.rerr = err
+	}
+	p.notEmpty.Broadcast()
+	p.notFull.Broadcast()
+}
+
+func (p *pipe) closeWrite(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.werr == nil {
+		p.werr = err
+	}
+	p.notEmpty.Broadcast()
+	p.notFull.Broadcast()
+}
+
+// PipeReader is the read half of a pipe.
+type PipeReader struct {
+	p *pipe
+}
+
+// Read blocks until data is available or the write half is closed. Buffered
+// data is still returned after the writer has been closed.
+func (r *PipeReader) Read(b []byte) (n int, err error) {
+	return r.p.read(b)
+}
+
+// Close closes the reader; subsequent writes return io.ErrClosedPipe.
+func (r *PipeReader) Close() error {
+	return r.CloseWithError(nil)
+}
+
+// CloseWithError closes the reader; subsequent writes return err. Blocked
+// writers are woken up.
+func (r *PipeReader) CloseWithError(err error) error {
+	r.p.closeRead(err)
+	return nil
+}
+
+// PipeWriter is the write half of a pipe.
+type PipeWriter struct {
+	p *pipe
+}
+
+// Write blocks until all of b has been copied into the buffer or the read half
+// is closed. Concurrent writes are not interleaved.
+func (w *PipeWriter) Write(b []byte) (n int, err error) {
+	return w.p.write(b)
+}
+
+// Close closes the writer; readers will get io.EOF after the buffer is drained.
+func (w *PipeWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+// CloseWithError closes the writer; readers will get err after the buffer is
+// drained. Blocked readers are woken up.
+func (w *PipeWriter) CloseWithError(err error) error {
+	w.p.closeWrite(err)
+	return nil
+}
+
+// Pipe creates a synchronous in-memory pipe with an internal buffer of size bytes.
+func Pipe(size int) (*PipeReader, *PipeWriter) {
+	if size <= 0 {
+		panic("pipe: size must be positive")
+	}
+	p := &pipe{b: make([]byte, size)}
+	p.notEmpty = sync.NewCond(&p.mu)
+	p.notFull = sync.NewCond(&p.mu)
+	return &PipeReader{p}, &PipeWriter{p}
+}
+
+func main() {
+	const producers, consumers, lines = 4, 3, 10000
+
+	pr, pw := Pipe(4096)
+
+	// Producers write whole lines with a single call to Write each.
+	var wg sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				if _, err := fmt.Fprintf(pw, "%d %d\n", id, j); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		pw.Close()
+	}()
+
+	// A single consumer splits the stream into lines; they must be intact and
+	// each producer's lines must arrive in order.
+	next := make(map[int]int)
+	br := bufio.NewReader(pr)
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fields := strings.Fields(line)
+		id, _ := strconv.Atoi(fields[0])
+		j, _ := strconv.Atoi(fields[1])
+		if next[id] != j {
+			log.Fatalf("producer #%d: got line %d, want %d", id, j, next[id])
+		}
+		next[id]++
+	}
+	var ids []int
+	for id := range next {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		log.Printf("producer #%d: %d lines", id, next[id])
+	}
+
+	// Several consumers share a pipe. They stop after a while and close the
+	// pipe with an error, which wakes up the blocked producer.
+	errEnough := errors.New("enough")
+	pr, pw = Pipe(64)
+	perr := make(chan error)
+	go func() {
+		for j := 0; ; j++ {
+			if _, err := fmt.Fprintf(pw, "%d\n", j); err != nil {
+				perr <- err
+				return
+			}
+		}
+	}()
+	var cwg sync.WaitGroup
+	var mu sync.Mutex
+	total := 0
+	counts := make([]int, consumers)
+	for i := 0; i < consumers; i++ {
+		cwg.Add(1)
+		go func(id int) {
+			defer cwg.Done()
+			buf := make([]byte, 16)
+			for {
+				k, err := pr.Read(buf)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				counts[id] += k
+				total += k
+				done := total > 100000
+				mu.Unlock()
+				if done {
+					pr.CloseWithError(errEnough)
+				}
+			}
+		}(i)
+	}
+	cwg.Wait()
+	err := <-perr
+	log.Printf("consumer closed the pipe early: %v", err)
+	if err != errEnough {
+		log.Fatalf("producer got %v, want %v", err, errEnough)
+	}
+	// No consumer is starved: each gets at least a fifth of a fair share.
+	for id, n := range counts {
+		log.Printf("consumer #%d read %d bytes", id, n)
+		if n < total/consumers/5 {
+			log.Fatalf("consumer #%d starved: %d of %d bytes", id, n, total)
+		}
+	}
+
+	// A write, that does not fit into the buffer, blocks until the reader is
+	// closed and then returns the error of the reader.
+	pr, pw = Pipe(4)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pr.CloseWithError(errEnough)
+	}()
+	n, err := pw.Write([]byte("0123456789"))
+	log.Printf("blocked write woken up: %d bytes, %v", n, err)
+	if err != errEnough {
+		log.Fatalf("blocked write got %v, want %v", err, errEnough)
+	}
+}
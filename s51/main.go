@@ -0,0 +1,267 @@
+// S51: A buffer, that spills over to disk.
+//
+// Small payloads are kept in memory, large payloads are moved to a temporary
+// file, once they exceed a given threshold. The buffer can be read again and
+// again, with io.ReaderAt and io.Seeker.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     Hello Gophers
+//     Hello Gophers
+//     2017/03/04 13:48:22 14 bytes, spilled to disk: false
+//     2017/03/04 13:48:22 r1: 67108864 bytes, sha1 22d124a93e9079b5c74b3d09a1cfde5337de51f9
+//     2017/03/04 13:48:22 r2: 67108864 bytes, sha1 22d124a93e9079b5c74b3d09a1cfde5337de51f9
+//     2017/03/04 13:48:22 67108864 bytes, spilled to disk: true
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultThreshold is the number of bytes kept in memory before spilling to disk.
+const DefaultThreshold = 1 << 20
+
+// ErrClosed is returned, when a closed buffer is used.
+var ErrClosed = errors.New("spill: buffer closed")
+
+// Buffer keeps data in memory up to a threshold. Beyond that all data is moved
+// to a temporary file, which is removed on Close. Writes always append, reads
+// use their own offset, which can be changed with Seek.
+type Buffer struct {
+	Threshold int    // spill to disk, when buffer grows larger than this
+	Dir       string // directory for the temporary file, empty means os.TempDir
+
+	mem    bytes.Buffer
+	f      *os.File
+	size   int64 // total number of bytes written
+	off    int64 // read offset
+	closed bool
+}
+
+// NewBuffer creates a new buffer with a given threshold in bytes.
+func NewBuffer(threshold int) *Buffer {
+	return &Buffer{Threshold: threshold}
+}
+
+// Spilled reports, whether the data lives in a temporary file.
+func (b *Buffer) Spilled() bool {
+	return b.f != nil
+}
+
+// Size returns the number of bytes written to the buffer.
+func (b *Buffer) Size() int64 {
+	return b.size
+}
+
+// Write appends p to the buffer. It moves the data to a temporary file, once
+// the threshold is exceeded.
+func (b *Buffer) Write(p []byte) (n int, err error) {
+	if b.closed {
+		return 0, ErrClosed
+	}
+	if b.f == nil && b.mem.Len()+len(p) > b.Threshold {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+	if b.f != nil {
+		n, err = b.f.WriteAt(p, b.size)
+	} else {
+		n, err = b.mem.Write(p)
+	}
+	b.size += int64(n)
+	return n, err
+}
+
+// spill moves the in-memory data into a temporary file.
+func (b *Buffer) spill() error {
+	f, err := ioutil.TempFile(b.Dir, "spill-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b.mem.Bytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	b.f = f
+	b.mem = bytes.Buffer{}
+	return nil
+}
+
+// ReadAt reads len(p) bytes starting at offset off.
+func (b *Buffer) ReadAt(p []byte, off int64) (n int, err error) {
+	if b.closed {
+		return 0, ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("spill: negative offset")
+	}
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	if b.f != nil {
+		if rest := b.size - off; int64(len(p)) > rest {
+			n, err = b.f.ReadAt(p[:rest], off)
+			if err == nil {
+				err = io.EOF
+			}
+			return n, err
+		}
+		return b.f.ReadAt(p, off)
+	}
+	n = copy(p, b.mem.Bytes()[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Read reads from the current read offset.
+func (b *Buffer) Read(p []byte) (n int, err error) {
+	if len(p) == 0 && !b.closed {
+		return 0, nil
+	}
+	n, err = b.ReadAt(p, b.off)
+	b.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the read offset.
+func (b *Buffer) Seek(offset int64, whence int) (int64, error) {
+	if b.closed {
+		return 0, ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.off
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, errors.New("spill: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("spill: negative position")
+	}
+	b.off = offset
+	return offset, nil
+}
+
+// Close releases the memory and removes the temporary file, if any. It is
+// safe to call Close more than once.
+func (b *Buffer) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.mem = bytes.Buffer{}
+	if b.f == nil {
+		return nil
+	}
+	err := b.f.Close()
+	if rerr := os.Remove(b.f.Name()); err == nil {
+		err = rerr
+	}
+	b.f = nil
+	return err
+}
+
+// sectionCloser is a section of a shared buffer, that is released when the
+// last section is closed.
+type sectionCloser struct {
+	*io.SectionReader
+	release func() error
+	once    sync.Once
+}
+
+func (s *sectionCloser) Close() (err error) {
+	s.once.Do(func() { err = s.release() })
+	return err
+}
+
+// drainBody reads all of b and then returns two equivalent ReadClosers
+// yielding the same bytes, like drainBody in S40. Large bodies are not held in
+// memory, but in a temporary file, which is removed when both readers are
+// closed.
+func drainBody(b io.ReadCloser, threshold int) (r1, r2 io.ReadCloser, buf *Buffer, err error) {
+	buf = NewBuffer(threshold)
+	if _, err = io.Copy(buf, b); err != nil {
+		buf.Close()
+		return nil, b, nil, err
+	}
+	if err = b.Close(); err != nil {
+		buf.Close()
+		return nil, b, nil, err
+	}
+	var (
+		mu   sync.Mutex
+		refs = 2
+	)
+	release := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if refs--; refs == 0 {
+			return buf.Close()
+		}
+		return nil
+	}
+	r1 = &sectionCloser{SectionReader: io.NewSectionReader(buf, 0, buf.Size()), release: release}
+	r2 = &sectionCloser{SectionReader: io.NewSectionReader(buf, 0, buf.Size()), release: release}
+	return r1, r2, buf, nil
+}
+
+// digest returns the number of bytes and the SHA1 of a reader.
+func digest(r io.Reader) (int64, string, error) {
+	h := sha1.New()
+	n, err := io.Copy(h, r)
+	return n, fmt.Sprintf("%x", h.Sum(nil)), err
+}
+
+func main() {
+	// A small body stays in memory.
+	r := ioutil.NopCloser(strings.NewReader("Hello Gophers\n"))
+	r1, r2, buf, err := drainBody(r, DefaultThreshold)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := io.Copy(os.Stdout, io.MultiReader(r1, r2)); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%d bytes, spilled to disk: %v", buf.Size(), buf.Spilled())
+	r1.Close()
+	r2.Close()
+
+	// A larger body is moved to a temporary file. Only about DefaultThreshold
+	// bytes are held in memory at any time.
+	r = ioutil.NopCloser(io.LimitReader(rand.New(rand.NewSource(0)), 1<<26))
+	r1, r2, buf, err = drainBody(r, DefaultThreshold)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r1.Close()
+	defer r2.Close()
+	for i, r := range []io.Reader{r1, r2} {
+		n, h, err := digest(r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("r%d: %d bytes, sha1 %s", i+1, n, h)
+	}
+	log.Printf("%d bytes, spilled to disk: %v", buf.Size(), buf.Spilled())
+}
@@ -0,0 +1,223 @@
+// S52: A body, that can be read again.
+//
+// Unlike drainBody from S40, the body is not read up front. Bytes are captured
+// as they are read for the first time, and any number of readers can replay
+// them from the start later.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     2017/03/04 13:48:22 logged request body: Hello Gophers
+//     2017/03/04 13:48:22 attempt #1: 503 Service Unavailable
+//     2017/03/04 13:48:22 logged request body: Hello Gophers
+//     2017/03/04 13:48:22 attempt #2: 503 Service Unavailable
+//     2017/03/04 13:48:22 logged request body: Hello Gophers
+//     2017/03/04 13:48:22 attempt #3: 200 OK
+//     2017/03/04 13:48:22 read 1024 bytes of a large body: replay: body exceeds limit of 1024 bytes
+//     2017/03/04 13:48:22 source closed 1 time(s)
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// ErrTooLarge is returned, when the body grows beyond its limit.
+var ErrTooLarge = errors.New("replay: body exceeds limit")
+
+// ErrClosed is returned, when reading past the captured bytes of a closed body.
+var ErrClosed = errors.New("replay: body closed")
+
+// Body captures the bytes of a ReadCloser as they are read. It can be read
+// from directly, and Replay returns readers, that start over at the first byte.
+// It is safe to use Body and its replay readers from multiple goroutines.
+type Body struct {
+	mu     sync.Mutex
+	rc     io.ReadCloser
+	buf    []byte // bytes read from rc so far
+	max    int    // maximum number of bytes to capture, zero means no limit
+	err    error  // sticky error from rc, including io.EOF
+	off    int    // read offset of Body itself
+	closed bool
+	cerr   error // result of closing rc
+}
+
+// NewBody wraps rc. If max is positive, reading past max bytes fails with
+// an error wrapping ErrTooLarge.
+func NewBody(rc io.ReadCloser, max int) *Body {
+	return &Body{rc: rc, max: max}
+}
+
+// Read reads from the body, pulling from the source only when needed.
+func (b *Body) Read(p []byte) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err = b.readAt(p, b.off)
+	b.off += n
+	return n, err
+}
+
+// readAt reads captured bytes at off, reading from the source first, if off
+// is at the end of the captured bytes. Must be called with b.mu held.
+func (b *Body) readAt(p []byte, off int) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if off >= len(b.buf) {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if b.closed {
+			return 0, ErrClosed
+		}
+		b.fill(len(p))
+	}
+	n = copy(p, b.buf[off:])
+	if n == 0 {
+		return 0, b.err
+	}
+	return n, nil
+}
+
+// fill reads up to k more bytes from the source into the capture buffer.
+func (b *Body) fill(k int) {
+	if b.max > 0 {
+		rest := b.max - len(b.buf)
+		if k > rest {
+			// Read one more byte, so we know, whether there is more.
+			k = rest + 1
+		}
+	}
+	start := len(b.buf)
+	if cap(b.buf)-start < k {
+		nb := make([]byte, start, 2*cap(b.buf)+k)
+		copy(nb, b.buf)
+		b.buf = nb
+	}
+	n, err := b.rc.Read(b.buf[start : start+k])
+	b.buf = b.buf[:start+n]
+	if b.max > 0 && len(b.buf) > b.max {
+		b.buf = b.buf[:b.max]
+		err = fmt.Errorf("%w of %d bytes", ErrTooLarge, b.max)
+	}
+	if err != nil {
+		b.err = err
+	}
+}
+
+// Replay returns a new reader, that starts at the first byte of the body. It
+// reads from the source, when it gets past the bytes already captured. Closing
+// a replay reader does not close the body.
+func (b *Body) Replay() io.ReadCloser {
+	return &replayReader{b: b}
+}
+
+// Bytes returns a copy of the bytes captured so far.
+func (b *Body) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf...)
+}
+
+// Close closes the source exactly once. Captured bytes can still be replayed.
+func (b *Body) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		b.cerr = b.rc.Close()
+	}
+	return b.cerr
+}
+
+// replayReader reads a Body from the beginning.
+type replayReader struct {
+	b   *Body
+	off int
+}
+
+func (r *replayReader) Read(p []byte) (n int, err error) {
+	r.b.mu.Lock()
+	defer r.b.mu.Unlock()
+	n, err = r.b.readAt(p, r.off)
+	r.off += n
+	return n, err
+}
+
+func (r *replayReader) Close() error {
+	return nil
+}
+
+// countingCloser counts calls to Close.
+type countingCloser struct {
+	io.Reader
+	n int
+}
+
+func (c *countingCloser) Close() error {
+	c.n++
+	return nil
+}
+
+// logBody is a middleware, that logs the request body after the handler ran,
+// however much of it the handler consumed.
+func logBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := NewBody(r.Body, 1<<20)
+		r.Body = body
+		next.ServeHTTP(w, r)
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			log.Printf("logging failed: %v", err)
+			return
+		}
+		log.Printf("logged request body: %s", bytes.TrimSpace(body.Bytes()))
+	})
+}
+
+func main() {
+	// A server, that fails the first two times, but only after looking at the body.
+	var attempts int
+	ts := httptest.NewServer(logBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			io.CopyN(ioutil.Discard, r.Body, 5)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.Copy(w, r.Body)
+	})))
+	defer ts.Close()
+
+	// Retry a request with a body, each attempt replays the body from the start.
+	src := &countingCloser{Reader: strings.NewReader("Hello Gophers\n")}
+	body := NewBody(src, 1<<20)
+	for i := 1; i <= 3; i++ {
+		resp, err := http.Post(ts.URL, "text/plain", body.Replay())
+		if err != nil {
+			log.Fatal(err)
+		}
+		resp.Body.Close()
+		log.Printf("attempt #%d: %s", i, resp.Status)
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+	}
+
+	// Bodies beyond a limit fail instead of growing without bounds.
+	large := NewBody(ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 4096))), 1024)
+	n, err := io.Copy(ioutil.Discard, large)
+	log.Printf("read %d bytes of a large body: %v", n, err)
+
+	body.Close()
+	body.Close()
+	log.Printf("source closed %d time(s)", src.n)
+}
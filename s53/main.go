@@ -0,0 +1,181 @@
+// S53: Many goroutines reading whole records from a single reader.
+//
+// In S41 two goroutines share a reader, but lines can be torn apart. Here,
+// every record goes to exactly one consumer and is never split.
+//
+// OUTPUT:
+//
+//     $ go run -race main.go
+//     2017/03/04 13:48:22 worker #0: 23174 records
+//     2017/03/04 13:48:22 worker #1: 24927 records
+//     2017/03/04 13:48:22 worker #2: 20884 records
+//     2017/03/04 13:48:22 worker #3: 31015 records
+//     2017/03/04 13:48:22 100000 records, each seen exactly once
+//     2017/03/04 13:48:22 worker #1 got message: Hello
+//     2017/03/04 13:48:22 worker #1 got message: multi-line
+//     message
+//     2017/03/04 13:48:22 worker #1 got message: Gophers
+//
+// The distribution of records varies from run to run.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+)
+
+// SharedReader hands out whole records from a single reader to many
+// goroutines. Records are found with a bufio.SplitFunc, so lines, words or
+// framed messages all work.
+type SharedReader struct {
+	mu  sync.Mutex
+	s   *bufio.Scanner
+	err error
+}
+
+// NewSharedReader wraps a reader, split determines the records.
+func NewSharedReader(r io.Reader, split bufio.SplitFunc) *SharedReader {
+	s := bufio.NewScanner(r)
+	s.Split(split)
+	return &SharedReader{s: s}
+}
+
+// Buffer sets the initial buffer and the maximum record size, see bufio.Scanner.Buffer.
+// It must be called before the first call to Next.
+func (r *SharedReader) Buffer(buf []byte, max int) {
+	r.s.Buffer(buf, max)
+}
+
+// Next returns the next record. The record is a copy and belongs to the
+// caller. At the end of the input, Next returns io.EOF to all callers.
+func (r *SharedReader) Next() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if !r.s.Scan() {
+		r.err = r.s.Err()
+		if r.err == nil {
+			r.err = io.EOF
+		}
+		return nil, r.err
+	}
+	return append([]byte(nil), r.s.Bytes()...), nil
+}
+
+// ScanFrames is a split function for messages prefixed by their length as a
+// big endian uint32.
+func ScanFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(data) < 4 {
+		if atEOF && len(data) > 0 {
+			return 0, nil, errors.New("shared: truncated frame header")
+		}
+		return 0, nil, nil
+	}
+	size := int(binary.BigEndian.Uint32(data))
+	if len(data) < 4+size {
+		if atEOF {
+			return 0, nil, errors.New("shared: truncated frame")
+		}
+		return 0, nil, nil
+	}
+	return 4 + size, data[4 : 4+size], nil
+}
+
+// writeFrame writes a single length prefixed message.
+func writeFrame(w io.Writer, msg string) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(msg))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, msg)
+	return err
+}
+
+// consume runs n workers on a shared reader; f is called with each record.
+func consume(r *SharedReader, n int, f func(worker int, record []byte)) error {
+	var wg sync.WaitGroup
+	errc := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for {
+				b, err := r.Next()
+				if err == io.EOF {
+					return
+				}
+				if err != nil {
+					errc <- err
+					return
+				}
+				f(id, b)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	return <-errc
+}
+
+func main() {
+	const records, workers = 100000, 4
+
+	// A work queue over lines, without reading all input in advance.
+	pr, pw := io.Pipe()
+	go func() {
+		bw := bufio.NewWriter(pw)
+		for i := 0; i < records; i++ {
+			fmt.Fprintf(bw, "%d\n", i)
+		}
+		pw.CloseWithError(bw.Flush())
+	}()
+
+	var mu sync.Mutex
+	seen := make([]int, records)
+	counts := make([]int, workers)
+	err := consume(NewSharedReader(pr, bufio.ScanLines), workers, func(id int, b []byte) {
+		v, err := strconv.Atoi(string(b))
+		if err != nil {
+			log.Fatalf("torn record: %q", b)
+		}
+		mu.Lock()
+		seen[v]++
+		counts[id]++
+		mu.Unlock()
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for id, c := range counts {
+		log.Printf("worker #%d: %d records", id, c)
+	}
+	for v, c := range seen {
+		if c != 1 {
+			log.Fatalf("record %d seen %d times", v, c)
+		}
+	}
+	log.Printf("%d records, each seen exactly once", records)
+
+	// Framed messages may contain newlines.
+	var buf bytes.Buffer
+	for _, msg := range []string{"Hello", "multi-line\nmessage", "Gophers"} {
+		if err := writeFrame(&buf, msg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	err = consume(NewSharedReader(&buf, ScanFrames), 2, func(id int, b []byte) {
+		log.Printf("worker #%d got message: %s", id, b)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,248 @@
+// S54: Process a single stream in parallel and keep the order.
+//
+// The input is cut into chunks, that end on a record boundary (like a
+// newline). Workers transform chunks concurrently and the results are written
+// in the original order. At most a few chunks per worker are in flight, so
+// memory use is bounded, regardless of the input size.
+//
+// OUTPUT:
+//
+//     $ cat ../s27a/main.go | go run main.go | head -4
+//     // S27A: BLACKBAR CENSORS GIVEN WORDS IN A STREAM.
+//     PACKAGE MAIN
+//
+//     IMPORT (
+//
+//     $ go run main.go -gen 2000000 > /dev/null
+//     2017/03/04 13:48:22 generated 2000000 lines
+//
+//     $ printf 'a\000b\000' | go run main.go -0 -size 1 | od -c
+//     0000000   A  \0   B  \0
+//     0000004
+//
+// With -gen, the program generates input and checks, that the output arrived in
+// order, with all available cores busy.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// DefaultChunkSize is the approximate size of a chunk handed to a worker.
+const DefaultChunkSize = 1 << 20
+
+// Processor runs F over chunks of a stream. Chunks always end with Delim, except
+// for the last one, which may lack a final delimiter.
+type Processor struct {
+	F         func([]byte) ([]byte, error)
+	Workers   int  // defaults to runtime.NumCPU
+	ChunkSize int  // defaults to DefaultChunkSize
+	Delim     byte // record delimiter, 0 is a NUL byte, as written by find -print0
+}
+
+// NewProcessor returns a processor for newline delimited records.
+func NewProcessor(f func([]byte) ([]byte, error)) *Processor {
+	return &Processor{F: f, Delim: '\n'}
+}
+
+// job is a single chunk, the result is delivered on its own channel.
+type job struct {
+	b      []byte
+	result chan result
+}
+
+type result struct {
+	b   []byte
+	err error
+}
+
+// Run reads from r, applies F to each chunk in parallel and writes the
+// results to w, in the same order as the input. It stops at the first error.
+func (p *Processor) Run(w io.Writer, r io.Reader) error {
+	workers, size, delim := p.Workers, p.ChunkSize, p.Delim
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+
+	var (
+		jobs  = make(chan job)            // for the workers
+		queue = make(chan job, 2*workers) // keeps the order, bounds memory
+		done  = make(chan struct{})       // closed, when the writer gives up
+		rerr  = make(chan error, 1)       // error from reading
+		wg    sync.WaitGroup
+		br    = bufio.NewReaderSize(r, size)
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				b, err := p.F(j.b)
+				j.result <- result{b, err}
+			}
+		}()
+	}
+
+	// The reader cuts the stream into chunks and hands them out.
+	go func() {
+		defer close(jobs)
+		defer close(queue)
+		for {
+			chunk, err := readChunk(br, size, delim)
+			if len(chunk) > 0 {
+				j := job{b: chunk, result: make(chan result, 1)}
+				select {
+				case queue <- j:
+				case <-done:
+					return
+				}
+				select {
+				case jobs <- j:
+				case <-done:
+					return
+				}
+			}
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				rerr <- err
+				return
+			}
+		}
+	}()
+
+	// Results are written in the order the chunks were read.
+	var err error
+	for j := range queue {
+		res := <-j.result
+		if res.err == nil {
+			_, res.err = w.Write(res.b)
+		}
+		if res.err != nil {
+			err = res.err
+			close(done)
+			break
+		}
+	}
+	if err != nil {
+		// Let the reader and workers finish. Results are buffered, so workers
+		// never block on an abandoned job.
+		for range queue {
+		}
+	}
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-rerr:
+	default:
+	}
+	return err
+}
+
+// readChunk reads about size bytes and then up to the next delimiter.
+func readChunk(br *bufio.Reader, size int, delim byte) ([]byte, error) {
+	chunk := make([]byte, size)
+	n, err := io.ReadFull(br, chunk)
+	chunk = chunk[:n]
+	if err == io.ErrUnexpectedEOF || (err == io.EOF && n == 0) {
+		return chunk, io.EOF
+	}
+	if err != nil {
+		return chunk, err
+	}
+	if chunk[n-1] == delim {
+		return chunk, nil
+	}
+	rest, err := br.ReadBytes(delim)
+	chunk = append(chunk, rest...)
+	if err == io.EOF {
+		// Signal EOF with the next call, there might still be data buffered.
+		return chunk, nil
+	}
+	return chunk, err
+}
+
+// upper is the transformation of S21, applied to a whole chunk.
+func upper(b []byte) ([]byte, error) {
+	return bytes.ToUpper(b), nil
+}
+
+// checkOrder verifies, that the lines are consecutive numbers.
+type checkOrder struct {
+	next int
+	buf  []byte
+}
+
+func (w *checkOrder) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		v, err := strconv.Atoi(string(w.buf[:i]))
+		if err != nil {
+			return 0, err
+		}
+		if v != w.next {
+			return 0, fmt.Errorf("out of order: got %d, want %d", v, w.next)
+		}
+		w.next++
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func main() {
+	gen := flag.Int("gen", 0, "generate this many lines and check the order of the output")
+	workers := flag.Int("w", runtime.NumCPU(), "number of workers")
+	size := flag.Int("size", DefaultChunkSize, "approximate chunk size in bytes")
+	nul := flag.Bool("0", false, "records end with a NUL byte instead of a newline")
+	flag.Parse()
+
+	p := NewProcessor(upper)
+	p.Workers, p.ChunkSize = *workers, *size
+	if *nul {
+		p.Delim = 0
+	}
+
+	if *gen > 0 {
+		pr, pw := io.Pipe()
+		go func() {
+			bw := bufio.NewWriter(pw)
+			for i := 0; i < *gen; i++ {
+				fmt.Fprintf(bw, "%d\n", i)
+			}
+			pw.CloseWithError(bw.Flush())
+		}()
+		co := &checkOrder{}
+		if err := p.Run(io.MultiWriter(os.Stdout, co), pr); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("generated %d lines", co.next)
+		return
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	defer bw.Flush()
+	if err := p.Run(bw, os.Stdin); err != nil {
+		log.Fatal(err)
+	}
+}
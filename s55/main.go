@@ -0,0 +1,201 @@
+// S55: Callbacks, that fire exactly once.
+//
+// The onEOFreader from S42 calls its function each time Read returns io.EOF,
+// which can happen more than once. Here, each hook fires at most once and gets
+// to know, how long it took and how many bytes were read.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     2017/03/04 13:48:22 first byte after 201ms
+//     2017/03/04 13:48:22 EOF after 800ms, 3072 bytes
+//     2017/03/04 13:48:22 closed after 1.2s, 3072 bytes
+//     2017/03/04 13:48:22 first byte after 0s
+//     2017/03/04 13:48:22 error after 0s, 1024 bytes: connection reset
+//     2017/03/04 13:48:22 closed after 0s, 1024 bytes
+//     2017/03/04 13:48:22 first byte after 0s
+//     2017/03/04 13:48:22 EOF after 2048 bytes, closing
+//     2017/03/04 13:48:22 closed after 0s, 2048 bytes
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event describes the state of a reader, when a hook fires.
+type Event struct {
+	N       int64         // number of bytes read so far
+	Elapsed time.Duration // time since the reader was created
+	Err     error         // the error for OnError and OnClose, nil otherwise
+}
+
+// Hooks are called at most once each. Any of them may be nil. Hooks are called
+// without holding a lock, so they may call Close on the reader.
+type Hooks struct {
+	OnFirstByte func(Event)
+	OnEOF       func(Event)
+	OnError     func(Event)
+	OnClose     func(Event)
+}
+
+// HookReader calls hooks on the first byte, EOF, the first error other than
+// EOF and on Close.
+type HookReader struct {
+	r     io.Reader
+	hooks Hooks
+	start time.Time
+
+	mu                      sync.Mutex
+	n                       int64
+	first, eof, failed, cls bool
+	cerr                    error
+}
+
+// NewHookReader wraps a reader. Durations are measured from this call.
+func NewHookReader(r io.Reader, hooks Hooks) *HookReader {
+	return &HookReader{r: r, hooks: hooks, start: time.Now()}
+}
+
+// event returns the current state. Must be called with r.mu held.
+func (r *HookReader) event(err error) Event {
+	return Event{N: r.n, Elapsed: time.Since(r.start), Err: err}
+}
+
+// call is a hook due to fire, with its event.
+type call struct {
+	f func(Event)
+	e Event
+}
+
+// due marks a hook as fired and returns a call, if it has not fired yet. Must
+// be called with r.mu held; the call is made after r.mu is released.
+func due(calls []call, f func(Event), fired *bool, e Event) []call {
+	if *fired {
+		return calls
+	}
+	*fired = true
+	if f != nil {
+		calls = append(calls, call{f, e})
+	}
+	return calls
+}
+
+// Read reads from the wrapped reader and fires hooks as needed.
+func (r *HookReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	var calls []call
+	r.mu.Lock()
+	r.n += int64(n)
+	if n > 0 {
+		calls = due(calls, r.hooks.OnFirstByte, &r.first, r.event(nil))
+	}
+	switch {
+	case err == io.EOF:
+		calls = due(calls, r.hooks.OnEOF, &r.eof, r.event(nil))
+	case err != nil:
+		calls = due(calls, r.hooks.OnError, &r.failed, r.event(err))
+	}
+	r.mu.Unlock()
+	for _, c := range calls {
+		c.f(c.e)
+	}
+	return n, err
+}
+
+// Close closes the wrapped reader, if it is an io.Closer, and fires OnClose.
+// It is safe to call Close more than once, the wrapped reader is closed only once.
+func (r *HookReader) Close() error {
+	r.mu.Lock()
+	if r.cls {
+		r.mu.Unlock()
+		return r.cerr
+	}
+	if c, ok := r.r.(io.Closer); ok {
+		r.cerr = c.Close()
+	}
+	calls := due(nil, r.hooks.OnClose, &r.cls, r.event(r.cerr))
+	r.mu.Unlock()
+	for _, c := range calls {
+		c.f(c.e)
+	}
+	return r.cerr
+}
+
+// SlowReader inserts a delay before each read, compare S26.
+type SlowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (r *SlowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.r.Read(p)
+}
+
+// brokenReader fails after some bytes, like a dropped connection.
+type brokenReader struct {
+	r io.Reader
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+// logHooks logs each event, rounding durations for readability.
+var logHooks = Hooks{
+	OnFirstByte: func(e Event) {
+		log.Printf("first byte after %s", e.Elapsed.Round(time.Millisecond))
+	},
+	OnEOF: func(e Event) {
+		log.Printf("EOF after %s, %d bytes", e.Elapsed.Round(100*time.Millisecond), e.N)
+	},
+	OnError: func(e Event) {
+		log.Printf("error after %s, %d bytes: %v", e.Elapsed.Round(100*time.Millisecond), e.N, e.Err)
+	},
+	OnClose: func(e Event) {
+		log.Printf("closed after %s, %d bytes", e.Elapsed.Round(100*time.Millisecond), e.N)
+	},
+}
+
+func main() {
+	// A slow download. Reading until EOF and then some more, OnEOF fires only once.
+	slow := &SlowReader{r: strings.NewReader(strings.Repeat("x", 3072)), delay: 200 * time.Millisecond}
+	r := NewHookReader(ioutil.NopCloser(slow), logHooks)
+	buf := make([]byte, 1024)
+	for i := 0; i < 6; i++ {
+		r.Read(buf)
+	}
+	r.Close()
+	r.Close()
+
+	// A broken download.
+	r = NewHookReader(&brokenReader{strings.NewReader(strings.Repeat("x", 1024))}, logHooks)
+	if _, err := io.Copy(ioutil.Discard, r); err == nil {
+		log.Fatal("expected an error")
+	}
+	r.Read(buf)
+	r.Close()
+
+	// Release resources as soon as the data is read.
+	hooks := logHooks
+	hooks.OnEOF = func(e Event) {
+		log.Printf("EOF after %d bytes, closing", e.N)
+		r.Close()
+	}
+	r = NewHookReader(ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 2048))), hooks)
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		log.Fatal(err)
+	}
+	r.Close()
+}
@@ -0,0 +1,235 @@
+// S56: Endless sources of data, that can be checked later.
+//
+// Like /dev/zero from S43, but with more patterns. Each byte only depends on
+// its offset, so every source implements io.ReaderAt and io.Seeker and any
+// part of the stream can be generated again to verify received data.
+//
+// OUTPUT:
+//
+//     $ go run main.go | xxd
+//     2017/03/04 13:48:22 1048576 bytes verified
+//     2017/03/04 13:48:22 corruption detected: mismatch at offset 106, got 0xec, want 0xed
+//     00000000: 0000 0000 0000 0000 0000 0000 0000 0008  ................
+//     00000010: 0000 0000 0000 0010 0000 0000 0000 0018  ................
+//     00000020: 476f 7068 6572 476f 7068 6572 476f 7068  GopherGopherGoph
+//     00000030: 6572 476f 7068 6572 476f 7068 6572 476f  erGopherGopherGo
+//     00000040: 6d28 b8d4 d659 ccd6 8c59 8625 a152 74c7  m(...Y...Y.%.Rt.
+//     00000050: 2a2a 2a2a 2a2a 2a2a 2a2a 2a2a 2a2a 2a2a  ****************
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+)
+
+// Pattern generates the bytes of an endless stream at a given offset.
+type Pattern interface {
+	Fill(p []byte, off int64)
+}
+
+// Constant is a single repeated byte, Constant(0) is /dev/zero.
+type Constant byte
+
+// Fill sets all bytes to c.
+func (c Constant) Fill(p []byte, off int64) {
+	for i := range p {
+		p[i] = byte(c)
+	}
+}
+
+// Repeat repeats a byte pattern. An empty pattern behaves like Constant(0).
+type Repeat []byte
+
+// Fill copies the pattern, starting at the right position.
+func (r Repeat) Fill(p []byte, off int64) {
+	if len(r) == 0 {
+		Constant(0).Fill(p, off)
+		return
+	}
+	i := int(off % int64(len(r)))
+	for n := 0; n < len(p); {
+		k := copy(p[n:], r[i:])
+		n += k
+		i = 0
+	}
+}
+
+// Counter writes the offset of each 8 byte word as a big endian uint64 into
+// the stream. When looking at a corrupted file, the data tells where it came from.
+type Counter struct{}
+
+// Fill writes the offsets.
+func (Counter) Fill(p []byte, off int64) {
+	fillWords(p, off, func(w uint64) uint64 { return w * 8 })
+}
+
+// Random is a fast, seeded pseudorandom stream. Unlike math/rand, each 8 byte
+// word is computed from the seed and the word index alone (splitmix64), so it
+// can be generated at any offset.
+type Random uint64
+
+// Fill generates random bytes.
+func (r Random) Fill(p []byte, off int64) {
+	fillWords(p, off, func(w uint64) uint64 { return splitmix64(uint64(r) + w*0x9e3779b97f4a7c15) })
+}
+
+// splitmix64 is the finalizer of the SplitMix64 generator.
+func splitmix64(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// fillWords fills p with big endian words, computed from the word index.
+func fillWords(p []byte, off int64, word func(uint64) uint64) {
+	var buf [8]byte
+	w := uint64(off / 8)
+	skip := int(off % 8)
+	for n := 0; n < len(p); w++ {
+		binary.BigEndian.PutUint64(buf[:], word(w))
+		n += copy(p[n:], buf[skip:])
+		skip = 0
+	}
+}
+
+// Source is an endless stream generated from a pattern. It never returns
+// io.EOF, use io.LimitReader or io.NewSectionReader to limit it.
+type Source struct {
+	p   Pattern
+	off int64
+}
+
+// NewSource creates a stream from a pattern.
+func NewSource(p Pattern) *Source {
+	return &Source{p: p}
+}
+
+// Read fills p completely.
+func (s *Source) Read(p []byte) (n int, err error) {
+	s.p.Fill(p, s.off)
+	s.off += int64(len(p))
+	return len(p), nil
+}
+
+// ReadAt fills p with the bytes at offset off.
+func (s *Source) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("pattern: negative offset")
+	}
+	s.p.Fill(p, off)
+	return len(p), nil
+}
+
+// Seek sets the offset for the next Read. An endless stream has no end, so
+// io.SeekEnd is not supported.
+func (s *Source) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.off
+	default:
+		return 0, errors.New("pattern: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("pattern: negative position")
+	}
+	s.off = offset
+	return offset, nil
+}
+
+// MismatchError reports the first byte, that differs from the pattern.
+type MismatchError struct {
+	Offset    int64
+	Got, Want byte
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("mismatch at offset %d, got 0x%02x, want 0x%02x", e.Offset, e.Got, e.Want)
+}
+
+// Verify reads r until EOF and compares it with the pattern, starting at off.
+// It returns the number of bytes verified and a *MismatchError on corruption.
+func Verify(r io.Reader, p Pattern, off int64) (int64, error) {
+	buf, want := make([]byte, 32*1024), make([]byte, 32*1024)
+	var n int64
+	for {
+		k, err := r.Read(buf)
+		p.Fill(want[:k], off+n)
+		for i := 0; i < k; i++ {
+			if buf[i] != want[i] {
+				return n + int64(i), &MismatchError{Offset: off + n + int64(i), Got: buf[i], Want: want[i]}
+			}
+		}
+		n += int64(k)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// Flaky flips bits with a given probability, like in S44.
+type Flaky struct {
+	r    io.Reader
+	prob float64
+	rand *rand.Rand
+}
+
+func (r *Flaky) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for i := range p[:n] {
+		if r.rand.Float64() < r.prob {
+			p[i] ^= 1
+		}
+	}
+	return n, err
+}
+
+func main() {
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	// Offsets and a repeating pattern.
+	if _, err := io.Copy(w, io.LimitReader(NewSource(Counter{}), 32)); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := io.Copy(w, io.NewSectionReader(NewSource(Repeat("Gopher")), 0, 32)); err != nil {
+		log.Fatal(err)
+	}
+	w.Flush()
+
+	// Random data is reproducible, so the receiver can check it.
+	const seed, size = 42, 1 << 20
+	n, err := Verify(io.LimitReader(NewSource(Random(seed)), size), Random(seed), 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%d bytes verified", n)
+
+	// Flipped bits are caught.
+	flaky := &Flaky{r: io.LimitReader(NewSource(Random(seed)), size), prob: 0.001, rand: rand.New(rand.NewSource(1))}
+	if _, err := Verify(flaky, Random(seed), 0); err != nil {
+		log.Printf("corruption detected: %v", err)
+	}
+
+	// Any offset can be generated again, without generating what came before.
+	src := NewSource(Random(seed))
+	if _, err := src.Seek(1<<40, io.SeekStart); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := io.CopyN(w, src, 16); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := io.CopyN(w, NewSource(Constant('*')), 16); err != nil {
+		log.Fatal(err)
+	}
+}
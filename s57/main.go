@@ -0,0 +1,332 @@
+// S57: Injecting faults into readers and writers, repeatably.
+//
+// Flaky from S44 and FlakyWriter from S45 fail at random, which makes for
+// tests, that fail only sometimes. Here, faults are either scripted at a
+// given offset or happen with a probability, drawn from a seeded source. The
+// same seed gives the same faults every time.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     flip at 4:          "Hellk World!" <nil>
+//     drop at 0, 5:       "elloWorld!" <nil>
+//     duplicate at 6:     "Hello WWorld!" <nil>
+//     truncate at 5:      "Hello" <nil>
+//     error at 8:         "Hello Wo" disk on fire
+//     short reads:        ["Hell" "o World" "!"] <nil>
+//     flip 10%, seed 1:   "Hello G\x7frld!" <nil>
+//     flip 10%, seed 1:   "Hello G\x7frld!" <nil>
+//     flip 10%, seed 7:   "Hello Wobld!" <nil>
+//     panic at 3:         recovered: fault: injected panic at offset 3
+//     short write at 4:   "Hello World!" in 2 writes
+//     writer error at 6:  "Hello " 6 disk on fire
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+)
+
+// Kind is the kind of fault.
+type Kind int
+
+const (
+	Flip      Kind = iota // flip a bit
+	Drop                  // drop a byte
+	Duplicate             // emit a byte twice
+	Truncate              // end the stream early, with io.EOF
+	Error                 // fail with an error
+	Short                 // return fewer bytes than possible
+	Panic                 // panic
+)
+
+// Fault describes a single fault. If Prob is zero, the fault happens exactly
+// once at the input offset At. Otherwise it happens with probability Prob, per
+// byte for Flip, Drop and Duplicate, per call for the others.
+type Fault struct {
+	Kind Kind
+	At   int64
+	Prob float64
+	Err  error // for Error, defaults to ErrInjected
+}
+
+// ErrInjected is the default error for Error faults.
+var ErrInjected = errors.New("fault: injected error")
+
+// Convenience constructors for the most common faults.
+func FlipAt(off int64) Fault                 { return Fault{Kind: Flip, At: off} }
+func DropAt(off int64) Fault                 { return Fault{Kind: Drop, At: off} }
+func DuplicateAt(off int64) Fault            { return Fault{Kind: Duplicate, At: off} }
+func TruncateAt(off int64) Fault             { return Fault{Kind: Truncate, At: off} }
+func ErrorAt(off int64, err error) Fault     { return Fault{Kind: Error, At: off, Err: err} }
+func PanicAt(off int64) Fault                { return Fault{Kind: Panic, At: off} }
+func WithProb(kind Kind, prob float64) Fault { return Fault{Kind: kind, Prob: prob} }
+
+// Injector is a set of faults. It creates readers and writers, each with its
+// own random source seeded with Seed, so results are repeatable.
+type Injector struct {
+	Seed   int64
+	Faults []Fault
+}
+
+// NewInjector creates an injector with a seed and a list of faults.
+func NewInjector(seed int64, faults ...Fault) *Injector {
+	return &Injector{Seed: seed, Faults: faults}
+}
+
+// stream keeps track of the offset and randomness of a single reader or writer.
+type stream struct {
+	faults []Fault
+	rand   *rand.Rand
+	off    int64 // offset in the input
+	err    error // sticky error
+}
+
+func (in *Injector) stream() *stream {
+	return &stream{faults: in.Faults, rand: rand.New(rand.NewSource(in.Seed))}
+}
+
+// hit reports, whether a fault happens at the given offset.
+func (s *stream) hit(f Fault, off int64) bool {
+	if f.Prob > 0 {
+		return s.rand.Float64() < f.Prob
+	}
+	return f.At == off
+}
+
+// limit returns how many of the next want bytes may pass, before a Truncate,
+// Error, Panic or Short fault stops the stream. If the fault is right at the
+// current offset, it takes effect: it returns an error, or panics. The short
+// flag is set, if a Short fault reduced the number of bytes.
+func (s *stream) limit(want int) (n int, short bool, err error) {
+	if s.err != nil {
+		return 0, false, s.err
+	}
+	n = want
+	for _, f := range s.faults {
+		switch f.Kind {
+		case Truncate, Error, Panic:
+			if f.Prob > 0 {
+				if s.rand.Float64() >= f.Prob {
+					continue
+				}
+			} else if f.At < s.off || f.At >= s.off+int64(n) {
+				continue
+			} else if f.At > s.off {
+				n = int(f.At - s.off)
+				continue
+			}
+			switch f.Kind {
+			case Truncate:
+				s.err = io.EOF
+			case Error:
+				s.err = f.Err
+				if s.err == nil {
+					s.err = ErrInjected
+				}
+			case Panic:
+				panic(fmt.Sprintf("fault: injected panic at offset %d", s.off))
+			}
+			return 0, false, s.err
+		case Short:
+			if f.Prob > 0 {
+				if n > 1 && s.rand.Float64() < f.Prob {
+					n, short = 1+s.rand.Intn(n-1), true
+				}
+			} else if f.At > s.off && f.At < s.off+int64(n) {
+				n, short = int(f.At-s.off), true
+			}
+		}
+	}
+	return n, short, nil
+}
+
+// apply appends the bytes in b to out, with Flip, Drop and Duplicate faults
+// applied. Offsets refer to the input.
+func (s *stream) apply(out, b []byte) []byte {
+	for i, c := range b {
+		off := s.off + int64(i)
+		emit := 1
+		for _, f := range s.faults {
+			switch f.Kind {
+			case Flip:
+				if s.hit(f, off) {
+					c ^= 1 << uint(s.rand.Intn(8))
+				}
+			case Drop:
+				if s.hit(f, off) {
+					emit = 0
+				}
+			case Duplicate:
+				if s.hit(f, off) && emit > 0 {
+					emit = 2
+				}
+			}
+		}
+		for j := 0; j < emit; j++ {
+			out = append(out, c)
+		}
+	}
+	s.off += int64(len(b))
+	return out
+}
+
+// Reader injects faults into a reader.
+type Reader struct {
+	r       io.Reader
+	s       *stream
+	buf     []byte // read from r
+	pending []byte // faulty bytes not yet returned
+}
+
+// Reader wraps r.
+func (in *Injector) Reader(r io.Reader) *Reader {
+	return &Reader{r: r, s: in.stream()}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(r.pending) == 0 {
+		n, _, err := r.s.limit(len(p))
+		if err != nil {
+			return 0, err
+		}
+		if cap(r.buf) < n {
+			r.buf = make([]byte, n)
+		}
+		k, err := r.r.Read(r.buf[:n])
+		r.pending = r.s.apply(r.pending, r.buf[:k])
+		if err != nil {
+			if len(r.pending) == 0 {
+				return 0, err
+			}
+			r.s.err = err
+			break
+		}
+		if k == 0 {
+			return 0, nil
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Writer injects faults into a writer.
+type Writer struct {
+	w   io.Writer
+	s   *stream
+	out []byte
+}
+
+// Writer wraps w. A Truncate fault makes the writer fail with io.ErrShortWrite.
+func (in *Injector) Writer(w io.Writer) *Writer {
+	return &Writer{w: w, s: in.stream()}
+}
+
+// Write passes p on to the wrapped writer, with faults applied. The returned
+// count refers to bytes of p, not to the bytes written to the wrapped writer.
+func (w *Writer) Write(p []byte) (written int, err error) {
+	for written < len(p) {
+		n, short, err := w.s.limit(len(p) - written)
+		if err == io.EOF {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return written, err
+		}
+		w.out = w.s.apply(w.out[:0], p[written:written+n])
+		if _, err := w.w.Write(w.out); err != nil {
+			w.s.err = err
+			return written, err
+		}
+		written += n
+		if short {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+const s = "Hello World!"
+
+// read reads all data from a reader with injected faults.
+func read(in *Injector) (string, error) {
+	b, err := ioutil.ReadAll(in.Reader(strings.NewReader(s)))
+	return string(b), err
+}
+
+// chunks records the result of each read.
+func chunks(in *Injector) ([]string, error) {
+	var result []string
+	r := in.Reader(strings.NewReader(s))
+	p := make([]byte, 8)
+	for {
+		n, err := r.Read(p)
+		if n > 0 {
+			result = append(result, string(p[:n]))
+		}
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+}
+
+func main() {
+	fire := errors.New("disk on fire")
+
+	show := func(label string, in *Injector) {
+		b, err := read(in)
+		fmt.Printf("%-20s%q %v\n", label, b, err)
+	}
+	show("flip at 4:", NewInjector(0, FlipAt(4)))
+	show("drop at 0, 5:", NewInjector(0, DropAt(0), DropAt(5)))
+	show("duplicate at 6:", NewInjector(0, DuplicateAt(6)))
+	show("truncate at 5:", NewInjector(0, TruncateAt(5)))
+	show("error at 8:", NewInjector(0, ErrorAt(8, fire)))
+
+	c, err := chunks(NewInjector(3, WithProb(Short, 1)))
+	fmt.Printf("%-20s%q %v\n", "short reads:", c, err)
+
+	show("flip 10%, seed 1:", NewInjector(1, WithProb(Flip, 0.1)))
+	show("flip 10%, seed 1:", NewInjector(1, WithProb(Flip, 0.1)))
+	show("flip 10%, seed 7:", NewInjector(7, WithProb(Flip, 0.1)))
+
+	func() {
+		defer func() {
+			fmt.Printf("%-20srecovered: %v\n", "panic at 3:", recover())
+		}()
+		read(NewInjector(0, PanicAt(3)))
+	}()
+
+	// Writers take the same faults. A short write reports, how much of p has
+	// been written; the caller writes the rest with another call.
+	var buf bytes.Buffer
+	w := NewInjector(0, Fault{Kind: Short, At: 4}).Writer(&buf)
+	p := []byte(s)
+	var calls int
+	for len(p) > 0 {
+		n, err := w.Write(p)
+		calls++
+		p = p[n:]
+		if err != nil && err != io.ErrShortWrite {
+			break
+		}
+	}
+	fmt.Printf("%-20s%q in %d writes\n", "short write at 4:", buf.String(), calls)
+
+	buf.Reset()
+	n, err := io.Copy(NewInjector(0, ErrorAt(6, fire)).Writer(&buf), strings.NewReader(s))
+	fmt.Printf("%-20s%q %d %v\n", "writer error at 6:", buf.String(), n, err)
+}
@@ -0,0 +1,307 @@
+// S58: Detect the corruption, that Flaky introduces.
+//
+// The writer splits the stream into blocks and prefixes each block with its
+// length and a CRC-32C checksum. The reader verifies each block, before it
+// hands out a single byte of it. The checksum also covers the sequence number
+// of the block, so dropped, repeated or reordered blocks are caught. Close
+// writes an empty block, that marks the end of the stream; a stream cut off
+// anywhere else is reported as corrupt, not as io.EOF.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     Hello World!
+//     2017/03/04 13:48:22 block at offset 21 corrupt: checksum mismatch
+//     2017/03/04 13:48:22 1000 of 1000 flipped streams detected
+//     2017/03/04 13:48:22 cut off: block at offset 2064 corrupt: missing end of stream
+//     2017/03/04 13:48:22 dropped: block at offset 1032 corrupt: checksum mismatch
+//     2017/03/04 13:48:22 repeated: block at offset 2064 corrupt: checksum mismatch
+//     2017/03/04 13:48:22 flaky stream: block at offset 25800 corrupt: checksum mismatch
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+const (
+	// DefaultBlockSize is the maximum payload of a block.
+	DefaultBlockSize = 4096
+	// MaxBlockSize limits the block size a reader accepts.
+	MaxBlockSize = 1 << 20
+	// headerSize is length and checksum, both uint32.
+	headerSize = 8
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupt is returned, when a block fails verification. Offset is the
+// position of the block header in the framed stream.
+type ErrCorrupt struct {
+	Offset int64
+	Reason string
+}
+
+func (e *ErrCorrupt) Error() string {
+	return fmt.Sprintf("block at offset %d corrupt: %s", e.Offset, e.Reason)
+}
+
+var errClosed = errors.New("write after close")
+
+// checksum covers the sequence number and the length field, too, so a flipped
+// length or a block out of place is caught.
+func checksum(seq uint32, header, payload []byte) uint32 {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], seq)
+	crc := crc32.Update(0, castagnoli, b[:])
+	crc = crc32.Update(crc, castagnoli, header[:4])
+	return crc32.Update(crc, castagnoli, payload)
+}
+
+// Writer frames data into checksummed blocks.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+	seq uint32 // sequence number of the next block
+	err error
+}
+
+// NewWriter creates a new writer with DefaultBlockSize.
+func NewWriter(w io.Writer) *Writer {
+	return NewWriterSize(w, DefaultBlockSize)
+}
+
+// NewWriterSize creates a new writer with a given block size.
+func NewWriterSize(w io.Writer, size int) *Writer {
+	if size <= 0 || size > MaxBlockSize {
+		size = DefaultBlockSize
+	}
+	return &Writer{w: w, buf: make([]byte, headerSize, headerSize+size)}
+}
+
+// Write buffers p and writes out full blocks.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	for len(p) > 0 && w.err == nil {
+		k := cap(w.buf) - len(w.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		w.buf = append(w.buf, p[:k]...)
+		p = p[k:]
+		n += k
+		if len(w.buf) == cap(w.buf) {
+			w.Flush()
+		}
+	}
+	return n, w.err
+}
+
+// Flush writes buffered data as a block, which may be shorter than the block
+// size. Use it, when the other side of a connection needs the data now.
+func (w *Writer) Flush() error {
+	if w.err != nil || len(w.buf) == headerSize {
+		return w.err
+	}
+	return w.block()
+}
+
+// block writes the buffer as a block, an empty one marks the end.
+func (w *Writer) block() error {
+	payload := w.buf[headerSize:]
+	binary.BigEndian.PutUint32(w.buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(w.buf[4:8], checksum(w.seq, w.buf, payload))
+	if _, err := w.w.Write(w.buf); err != nil {
+		w.err = err
+		return err
+	}
+	w.seq++
+	w.buf = w.buf[:headerSize]
+	return nil
+}
+
+// Close flushes the last block and writes the end of stream block. It does
+// not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		if w.err == errClosed {
+			return nil
+		}
+		return w.err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := w.block(); err != nil {
+		return err
+	}
+	w.err = errClosed
+	return nil
+}
+
+// Reader verifies blocks written by Writer.
+type Reader struct {
+	r       io.Reader
+	off     int64  // offset of the next block header
+	seq     uint32 // sequence number of the next block
+	header  [headerSize]byte
+	buf     []byte
+	payload []byte // verified, unread bytes
+	err     error
+}
+
+// NewReader creates a new verifying reader.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Read returns verified data only. On a checksum mismatch it returns an
+// *ErrCorrupt and no data of the affected block. It returns io.EOF only after
+// the end of stream block.
+func (r *Reader) Read(p []byte) (n int, err error) {
+	for len(r.payload) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n = copy(p, r.payload)
+	r.payload = r.payload[n:]
+	return n, nil
+}
+
+// next reads and verifies the next block.
+func (r *Reader) next() error {
+	off := r.off
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		switch err {
+		case io.EOF:
+			return &ErrCorrupt{Offset: off, Reason: "missing end of stream"}
+		case io.ErrUnexpectedEOF:
+			return &ErrCorrupt{Offset: off, Reason: "truncated header"}
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(r.header[0:4])
+	if size > MaxBlockSize {
+		return &ErrCorrupt{Offset: off, Reason: fmt.Sprintf("invalid block size %d", size)}
+	}
+	if cap(r.buf) < int(size) {
+		r.buf = make([]byte, size)
+	}
+	r.buf = r.buf[:size]
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return &ErrCorrupt{Offset: off, Reason: "truncated block"}
+		}
+		return err
+	}
+	r.off += headerSize + int64(size)
+	if checksum(r.seq, r.header[:], r.buf) != binary.BigEndian.Uint32(r.header[4:8]) {
+		return &ErrCorrupt{Offset: off, Reason: "checksum mismatch"}
+	}
+	r.seq++
+	if size == 0 {
+		return io.EOF
+	}
+	r.payload = r.buf
+	return nil
+}
+
+// Flaky flips each byte with a given probability, like in S44, but only the
+// bytes actually read, and with its own random source.
+type Flaky struct {
+	r    io.Reader
+	prob float64
+	rand *rand.Rand
+}
+
+func (r *Flaky) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for i := range p[:n] {
+		if r.rand.Float64() < r.prob {
+			p[i] = p[i] + 1
+		}
+	}
+	return n, err
+}
+
+// flipOne flips a single random bit.
+func flipOne(b []byte, rnd *rand.Rand) []byte {
+	c := append([]byte(nil), b...)
+	c[rnd.Intn(len(c))] ^= 1 << uint(rnd.Intn(8))
+	return c
+}
+
+func main() {
+	// Framing is transparent.
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	io.WriteString(w, "Hello World!\n")
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	if _, err := io.Copy(os.Stdout, NewReader(bytes.NewReader(encoded))); err != nil {
+		log.Fatal(err)
+	}
+
+	// A single flipped bit is caught.
+	rnd := rand.New(rand.NewSource(1))
+	_, err := io.Copy(ioutil.Discard, NewReader(bytes.NewReader(flipOne(encoded, rnd))))
+	var ce *ErrCorrupt
+	if errors.As(err, &ce) {
+		log.Print(ce)
+	}
+
+	// Flip a random bit in a larger stream, many times over.
+	buf.Reset()
+	w = NewWriterSize(&buf, 1024)
+	bw := bufio.NewWriter(w)
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(bw, "%d\t%s\n", i, strings.Repeat("x", i%80))
+	}
+	bw.Flush()
+	w.Close()
+	encoded = append([]byte(nil), buf.Bytes()...)
+
+	const trials = 1000
+	var detected int
+	for i := 0; i < trials; i++ {
+		_, err := io.Copy(ioutil.Discard, NewReader(bytes.NewReader(flipOne(encoded, rnd))))
+		if errors.As(err, &ce) {
+			detected++
+		}
+	}
+	log.Printf("%d of %d flipped streams detected", detected, trials)
+
+	// Blocks cut off, dropped or repeated. The blocks are 1032 bytes each.
+	const bs = headerSize + 1024
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"cut off", encoded[:2*bs]},
+		{"dropped", append(append([]byte(nil), encoded[:bs]...), encoded[2*bs:]...)},
+		{"repeated", append(append([]byte(nil), encoded[:2*bs]...), encoded[bs:]...)},
+	} {
+		_, err := io.Copy(ioutil.Discard, NewReader(bytes.NewReader(c.data)))
+		log.Printf("%s: %v", c.name, err)
+	}
+
+	// The flaky reader from S44.
+	flaky := &Flaky{r: bytes.NewReader(encoded), prob: 0.0001, rand: rand.New(rand.NewSource(2))}
+	if _, err := io.Copy(ioutil.Discard, NewReader(flaky)); err != nil {
+		log.Printf("flaky stream: %v", err)
+	}
+}
@@ -0,0 +1,498 @@
+// S59: Repair flipped bytes with forward error correction.
+//
+// The writer encodes the stream in blocks of 255 bytes with a Reed-Solomon
+// code. Each block carries 2t parity bytes, and the reader can repair up to t
+// corrupted bytes per block, without asking for a resend. With more damage,
+// the reader reports an error instead of returning wrong data.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     Hello World!
+//     Hello World!
+//     2017/03/04 13:48:22 1000 of 1000 blocks with up to 4 flipped bytes repaired
+//     2017/03/04 13:48:22 flaky stream: 132 bytes repaired, text intact: true
+//     2017/03/04 13:48:22 too much damage: block at offset 0: too many errors to correct
+//     2017/03/04 13:48:22 cut off: block at offset 255: missing end of stream
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// Arithmetic in GF(2^8), with the primitive polynomial x^8+x^4+x^3+x^2+1.
+var gfExp [512]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(x, y byte) byte {
+	if x == 0 || y == 0 {
+		return 0
+	}
+	return gfExp[gfLog[x]+gfLog[y]]
+}
+
+func gfDiv(x, y byte) byte {
+	if y == 0 {
+		panic("fec: division by zero")
+	}
+	if x == 0 {
+		return 0
+	}
+	return gfExp[(gfLog[x]+255-gfLog[y])%255]
+}
+
+func gfPow(x byte, power int) byte {
+	e := (gfLog[x] * power) % 255
+	if e < 0 {
+		e += 255
+	}
+	return gfExp[e]
+}
+
+func gfInverse(x byte) byte {
+	return gfExp[255-gfLog[x]]
+}
+
+// Polynomials are byte slices, highest degree first.
+
+func polyScale(p []byte, x byte) []byte {
+	r := make([]byte, len(p))
+	for i, c := range p {
+		r[i] = gfMul(c, x)
+	}
+	return r
+}
+
+func polyAdd(p, q []byte) []byte {
+	n := len(p)
+	if len(q) > n {
+		n = len(q)
+	}
+	r := make([]byte, n)
+	copy(r[n-len(p):], p)
+	for i, c := range q {
+		r[i+n-len(q)] ^= c
+	}
+	return r
+}
+
+func polyMul(p, q []byte) []byte {
+	r := make([]byte, len(p)+len(q)-1)
+	for j, b := range q {
+		for i, a := range p {
+			r[i+j] ^= gfMul(a, b)
+		}
+	}
+	return r
+}
+
+func polyEval(p []byte, x byte) byte {
+	y := p[0]
+	for _, c := range p[1:] {
+		y = gfMul(y, x) ^ c
+	}
+	return y
+}
+
+// polyRem returns the remainder of a polynomial division.
+func polyRem(dividend, divisor []byte) []byte {
+	out := append([]byte(nil), dividend...)
+	for i := 0; i < len(dividend)-(len(divisor)-1); i++ {
+		if c := out[i]; c != 0 {
+			for j := 1; j < len(divisor); j++ {
+				out[i+j] ^= gfMul(divisor[j], c)
+			}
+		}
+	}
+	return out[len(out)-(len(divisor)-1):]
+}
+
+func reverse(p []byte) []byte {
+	r := make([]byte, len(p))
+	for i, c := range p {
+		r[len(p)-1-i] = c
+	}
+	return r
+}
+
+// errTooMany is returned, when a codeword cannot be repaired.
+var errTooMany = errors.New("too many errors to correct")
+
+// Code is a Reed-Solomon code with nsym parity bytes.
+type Code struct {
+	nsym int
+	gen  []byte
+}
+
+// NewCode creates a code, that repairs up to t bytes per codeword. A block
+// has room for at least one byte of data, so t is at most 126.
+func NewCode(t int) *Code {
+	if t < 1 || 2*t > BlockSize-2 {
+		panic("fec: invalid number of correctable bytes")
+	}
+	gen := []byte{1}
+	for i := 0; i < 2*t; i++ {
+		gen = polyMul(gen, []byte{1, gfPow(2, i)})
+	}
+	return &Code{nsym: 2 * t, gen: gen}
+}
+
+// Encode returns a codeword: msg, followed by its parity bytes.
+func (c *Code) Encode(msg []byte) []byte {
+	out := make([]byte, len(msg)+c.nsym)
+	copy(out, msg)
+	for i := range msg {
+		if coef := out[i]; coef != 0 {
+			for j := 1; j < len(c.gen); j++ {
+				out[i+j] ^= gfMul(c.gen[j], coef)
+			}
+		}
+	}
+	copy(out, msg)
+	return out
+}
+
+// syndromes are all zero for an intact codeword.
+func (c *Code) syndromes(cw []byte) ([]byte, bool) {
+	synd := make([]byte, c.nsym+1)
+	ok := true
+	for i := 0; i < c.nsym; i++ {
+		synd[i+1] = polyEval(cw, gfPow(2, i))
+		if synd[i+1] != 0 {
+			ok = false
+		}
+	}
+	return synd, ok
+}
+
+// Decode repairs cw in place and returns the number of repaired bytes.
+func (c *Code) Decode(cw []byte) (int, error) {
+	synd, ok := c.syndromes(cw)
+	if ok {
+		return 0, nil
+	}
+	// Berlekamp-Massey finds the error locator polynomial.
+	errLoc, oldLoc := []byte{1}, []byte{1}
+	for i := 0; i < c.nsym; i++ {
+		k := i + 1
+		delta := synd[k]
+		for j := 1; j < len(errLoc); j++ {
+			delta ^= gfMul(errLoc[len(errLoc)-1-j], synd[k-j])
+		}
+		oldLoc = append(oldLoc, 0)
+		if delta != 0 {
+			if len(oldLoc) > len(errLoc) {
+				newLoc := polyScale(oldLoc, delta)
+				oldLoc = polyScale(errLoc, gfInverse(delta))
+				errLoc = newLoc
+			}
+			errLoc = polyAdd(errLoc, polyScale(oldLoc, delta))
+		}
+	}
+	for len(errLoc) > 0 && errLoc[0] == 0 {
+		errLoc = errLoc[1:]
+	}
+	errs := len(errLoc) - 1
+	if errs*2 > c.nsym {
+		return 0, errTooMany
+	}
+	// Chien search finds the positions of the errors.
+	rev := reverse(errLoc)
+	var pos []int
+	for i := 0; i < len(cw); i++ {
+		if polyEval(rev, gfPow(2, i)) == 0 {
+			pos = append(pos, len(cw)-1-i)
+		}
+	}
+	if len(pos) != errs {
+		return 0, errTooMany
+	}
+	// Forney computes the error values.
+	coefPos := make([]int, len(pos))
+	loc := []byte{1}
+	for i, p := range pos {
+		coefPos[i] = len(cw) - 1 - p
+		loc = polyMul(loc, polyAdd([]byte{1}, []byte{gfPow(2, coefPos[i]), 0}))
+	}
+	divisor := make([]byte, len(loc)+1)
+	divisor[0] = 1
+	eval := reverse(polyRem(polyMul(reverse(synd), loc), divisor))
+	xs := make([]byte, len(coefPos))
+	for i, cp := range coefPos {
+		xs[i] = gfPow(2, cp)
+	}
+	for i, xi := range xs {
+		xiInv := gfInverse(xi)
+		prime := byte(1)
+		for j, xj := range xs {
+			if j != i {
+				prime = gfMul(prime, 1^gfMul(xiInv, xj))
+			}
+		}
+		if prime == 0 {
+			return 0, errTooMany
+		}
+		y := gfMul(xi, polyEval(reverse(eval), xiInv))
+		cw[pos[i]] ^= gfDiv(y, prime)
+	}
+	if _, ok := c.syndromes(cw); !ok {
+		return 0, errTooMany
+	}
+	return len(pos), nil
+}
+
+// BlockSize is the size of a codeword. Each codeword holds a length byte,
+// up to 254-2t bytes of data and 2t parity bytes. A block of length zero marks
+// the end of the stream.
+const BlockSize = 255
+
+var errClosed = errors.New("fec: write after close")
+
+// Writer encodes a stream.
+type Writer struct {
+	w    io.Writer
+	code *Code
+	buf  []byte // pending data
+	err  error
+}
+
+// NewWriter creates a writer, whose output can be repaired, if no more than
+// t bytes per block are corrupted.
+func NewWriter(w io.Writer, t int) *Writer {
+	return &Writer{w: w, code: NewCode(t)}
+}
+
+func (w *Writer) dataSize() int {
+	return BlockSize - 1 - w.code.nsym
+}
+
+// Write buffers p and writes complete blocks.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	for len(p) > 0 && w.err == nil {
+		k := w.dataSize() - len(w.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		w.buf = append(w.buf, p[:k]...)
+		p, n = p[k:], n+k
+		if len(w.buf) == w.dataSize() {
+			w.flush()
+		}
+	}
+	return n, w.err
+}
+
+// flush writes a padded block with the number of valid bytes up front.
+func (w *Writer) flush() error {
+	if w.err != nil || len(w.buf) == 0 {
+		return w.err
+	}
+	return w.block()
+}
+
+// block encodes and writes the buffer, an empty one marks the end.
+func (w *Writer) block() error {
+	msg := make([]byte, 1+w.dataSize())
+	msg[0] = byte(len(w.buf))
+	copy(msg[1:], w.buf)
+	if _, err := w.w.Write(w.code.Encode(msg)); err != nil {
+		w.err = err
+	}
+	w.buf = w.buf[:0]
+	return w.err
+}
+
+// Close writes the last, possibly short block and the end of stream block. It
+// does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.err == errClosed {
+		return nil
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if err := w.block(); err != nil {
+		return err
+	}
+	w.err = errClosed
+	return nil
+}
+
+// BlockError is returned for a block, that could not be repaired.
+type BlockError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("block at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *BlockError) Unwrap() error { return e.Err }
+
+// Reader decodes and repairs a stream written by Writer.
+type Reader struct {
+	r        io.Reader
+	code     *Code
+	cw       []byte
+	data     []byte // repaired, unread data
+	off      int64
+	err      error
+	Repaired int // number of bytes repaired so far
+}
+
+// NewReader creates a reader; t must match the writer.
+func NewReader(r io.Reader, t int) *Reader {
+	return &Reader{r: r, code: NewCode(t), cw: make([]byte, BlockSize)}
+}
+
+func (r *Reader) Read(p []byte) (n int, err error) {
+	for len(r.data) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n = copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// next reads and repairs the next codeword.
+func (r *Reader) next() error {
+	if _, err := io.ReadFull(r.r, r.cw); err != nil {
+		switch err {
+		case io.EOF:
+			return &BlockError{Offset: r.off, Err: errors.New("missing end of stream")}
+		case io.ErrUnexpectedEOF:
+			return &BlockError{Offset: r.off, Err: err}
+		}
+		return err
+	}
+	k, err := r.code.Decode(r.cw)
+	if err != nil {
+		return &BlockError{Offset: r.off, Err: err}
+	}
+	r.Repaired += k
+	size := int(r.cw[0])
+	if size > BlockSize-1-r.code.nsym {
+		return &BlockError{Offset: r.off, Err: errors.New("invalid length")}
+	}
+	r.off += BlockSize
+	if size == 0 {
+		return io.EOF
+	}
+	r.data = r.cw[1 : 1+size]
+	return nil
+}
+
+// Flaky flips each byte with a given probability, like in S44, with its own
+// random source.
+type Flaky struct {
+	r    io.Reader
+	prob float64
+	rand *rand.Rand
+}
+
+func (r *Flaky) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for i := range p[:n] {
+		if r.rand.Float64() < r.prob {
+			p[i] = p[i] + 1
+		}
+	}
+	return n, err
+}
+
+// encode encodes s with t correctable bytes per block.
+func encode(s string, t int) []byte {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, t)
+	io.WriteString(w, s)
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func main() {
+	const t = 4
+	rnd := rand.New(rand.NewSource(1))
+
+	// Some flipped bytes are repaired transparently.
+	encoded := encode("Hello World!\n", t)
+	for i := 0; i < 2; i++ {
+		damaged := append([]byte(nil), encoded...)
+		for _, j := range rnd.Perm(len(damaged))[:t] {
+			damaged[j] ^= byte(1 + rnd.Intn(255))
+		}
+		if _, err := io.Copy(os.Stdout, NewReader(bytes.NewReader(damaged), t)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Up to t damaged bytes per block are always repaired.
+	const trials = 1000
+	code := NewCode(t)
+	var repaired int
+	for i := 0; i < trials; i++ {
+		msg := make([]byte, BlockSize-2*t)
+		rnd.Read(msg)
+		cw := code.Encode(msg)
+		for _, j := range rnd.Perm(len(cw))[:1+rnd.Intn(t)] {
+			cw[j] ^= byte(1 + rnd.Intn(255))
+		}
+		if _, err := code.Decode(cw); err == nil && bytes.Equal(cw[:len(msg)], msg) {
+			repaired++
+		}
+	}
+	log.Printf("%d of %d blocks with up to %d flipped bytes repaired", repaired, trials, t)
+
+	// The flaky reader from S44, flipping about one byte in a thousand.
+	text := strings.Repeat("Hello World!\n", 10000)
+	flaky := &Flaky{r: bytes.NewReader(encode(text, t)), prob: 0.001, rand: rnd}
+	r := NewReader(flaky, t)
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("flaky stream: %d bytes repaired, text intact: %v", r.Repaired, string(b) == text)
+
+	// Too many flipped bytes are detected.
+	damaged := encode("Hello World!\n", t)
+	for j := 0; j < 3*t; j++ {
+		damaged[j] ^= 0xff
+	}
+	if _, err := ioutil.ReadAll(NewReader(bytes.NewReader(damaged), t)); err != nil {
+		log.Printf("too much damage: %v", err)
+	}
+
+	// A stream cut off at a block boundary is not mistaken for the end.
+	if _, err := ioutil.ReadAll(NewReader(bytes.NewReader(encoded[:BlockSize]), t)); err != nil {
+		log.Printf("cut off: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+// S60: A sticky error writer, that counts.
+//
+// The stickyErrWriter from S45 keeps its error behind a pointer into another
+// struct. Here, the writer owns the error, counts the bytes written and
+// records the offset, at which writing failed.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     HELLO Alice
+//     Protocols often consist of various steps. Some are more chatty than others.
+//     mtu:1500;favorites={color:green,dessert:tiramisu}
+//     OK, 138 bytes written
+//
+//     HELLO Alice
+//     Protocols often consist of various steps. Some
+//     2017/03/04 13:48:22 protocol initialization failed: write failed at offset 58: disk full
+//     2017/03/04 13:48:22 disk full: true, failed at offset 58, 58 bytes written
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// WriteError records the offset at which a write failed.
+type WriteError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("write failed at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *WriteError) Unwrap() error { return e.Err }
+
+// ErrWriter keeps the first error around, so you can check it once, after
+// many writes. After an error, all writes are no-ops, that return the error.
+type ErrWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+// NewErrWriter wraps a writer.
+func NewErrWriter(w io.Writer) *ErrWriter {
+	return &ErrWriter{w: w}
+}
+
+// Write writes p, unless an earlier write failed.
+func (ew *ErrWriter) Write(p []byte) (n int, err error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	n, err = ew.w.Write(p)
+	ew.n += int64(n)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		ew.err = &WriteError{Offset: ew.n, Err: err}
+	}
+	return n, ew.err
+}
+
+// WriteString writes a string.
+func (ew *ErrWriter) WriteString(s string) (n int, err error) {
+	return ew.Write([]byte(s))
+}
+
+// Printf writes formatted output.
+func (ew *ErrWriter) Printf(format string, a ...interface{}) {
+	fmt.Fprintf(ew, format, a...)
+}
+
+// Err returns the first error, wrapped in a *WriteError, or nil.
+func (ew *ErrWriter) Err() error {
+	return ew.err
+}
+
+// N returns the number of bytes written successfully.
+func (ew *ErrWriter) N() int64 {
+	return ew.n
+}
+
+// ProtocolWriter writes the protocol from S45, checking for errors only once.
+type ProtocolWriter struct {
+	w *ErrWriter
+}
+
+// WriteHello says hi.
+func (p ProtocolWriter) WriteHello(name string) {
+	p.w.Printf("HELLO %s\n", name)
+}
+
+// WritePreamble writes a chatty preamble.
+func (p ProtocolWriter) WritePreamble() {
+	p.w.WriteString("Protocols often consist of various steps. Some are more chatty than others.\n")
+}
+
+// WriteSettings writes some important protocol settings.
+func (p ProtocolWriter) WriteSettings() {
+	p.w.Printf("mtu:%d;favorites={color:%s,dessert:%s}\n", 1500, "green", "tiramisu")
+}
+
+// ErrDiskFull is returned by LimitedWriter.
+var ErrDiskFull = errors.New("disk full")
+
+// LimitedWriter accepts only a limited number of bytes, then fails, like a
+// full disk.
+type LimitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *LimitedWriter) Write(p []byte) (n int, err error) {
+	if int64(len(p)) > w.n {
+		p, err = p[:w.n], ErrDiskFull
+	}
+	n, werr := w.w.Write(p)
+	w.n -= int64(n)
+	if werr != nil {
+		err = werr
+	}
+	return n, err
+}
+
+// initialize runs the protocol and checks for errors once, at the end. It
+// returns the number of bytes written.
+func initialize(w io.Writer) (int64, error) {
+	ew := NewErrWriter(w)
+	pw := ProtocolWriter{w: ew}
+	pw.WriteHello("Alice")
+	pw.WritePreamble()
+	pw.WriteSettings()
+	if err := ew.Err(); err != nil {
+		return ew.N(), fmt.Errorf("protocol initialization failed: %w", err)
+	}
+	return ew.N(), nil
+}
+
+func main() {
+	var buf bytes.Buffer
+	n, err := initialize(&buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print(buf.String())
+	fmt.Printf("OK, %d bytes written\n", n)
+
+	fmt.Println()
+	buf.Reset()
+	n, err = initialize(&LimitedWriter{w: &buf, n: 58})
+	fmt.Println(buf.String())
+	log.Print(err)
+
+	// The original error is still there.
+	var we *WriteError
+	if errors.As(err, &we) {
+		log.Printf("disk full: %v, failed at offset %d, %d bytes written",
+			errors.Is(err, ErrDiskFull), we.Offset, n)
+	}
+}
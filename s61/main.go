@@ -0,0 +1,458 @@
+// S61: A small text protocol, with an encoder and a decoder.
+//
+// The messages are the ones the ProtocolWriter from S45 writes. The encoder
+// checks for errors once, with a sticky error writer (S60). The decoder reads
+// the same messages back, including settings with nested maps.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     HELLO Alice
+//     Protocols often consist of various steps. Some are more chatty than others.
+//     mtu:1500;favorites={color:green,dessert:tiramisu}
+//     OK
+//
+//     hello: Alice
+//     preamble: Protocols often consist of various steps. Some are more chatty than others.
+//     settings: mtu:1500;favorites={color:green,dessert:tiramisu}
+//     favorite dessert: tiramisu
+//     round trip ok: true
+//     round trip of 6 edge cases ok
+//     2017/03/04 13:48:22 line 3: expected '{' at column 5
+//     2017/03/04 13:48:22 line 1: invalid name "Bob Smith"
+//     2017/03/04 13:48:22 invalid character in value "green;blue"
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Setting is a key with either a plain value or a nested map of settings.
+type Setting struct {
+	Key   string
+	Value string
+	Map   Settings // if not nil, the setting is a map
+}
+
+// Settings keeps the order of keys, so they can be written out as they were read.
+type Settings []Setting
+
+// Get returns the plain value for a key.
+func (s Settings) Get(key string) (string, bool) {
+	for _, v := range s {
+		if v.Key == key && v.Map == nil {
+			return v.Value, true
+		}
+	}
+	return "", false
+}
+
+// Sub returns the nested map for a key.
+func (s Settings) Sub(key string) Settings {
+	for _, v := range s {
+		if v.Key == key && v.Map != nil {
+			return v.Map
+		}
+	}
+	return nil
+}
+
+// special characters cannot appear in keys and values.
+const special = ":;=,{}\n\r"
+
+// String formats settings as they appear on the wire. Top level settings are
+// separated by semicolons, nested settings by commas.
+func (s Settings) String() string {
+	var buf strings.Builder
+	s.format(&buf, ";")
+	return buf.String()
+}
+
+func (s Settings) format(buf *strings.Builder, sep string) {
+	for i, v := range s {
+		if i > 0 {
+			buf.WriteString(sep)
+		}
+		buf.WriteString(v.Key)
+		if v.Map != nil {
+			buf.WriteString("={")
+			v.Map.format(buf, ",")
+			buf.WriteString("}")
+		} else {
+			buf.WriteString(":")
+			buf.WriteString(v.Value)
+		}
+	}
+}
+
+// maxDepth limits the nesting of maps.
+const maxDepth = 32
+
+// validate checks keys and values for special characters and the nesting
+// depth, so the encoder writes nothing the decoder rejects.
+func (s Settings) validate(depth int) error {
+	if depth > maxDepth {
+		return errors.New("maps nested too deeply")
+	}
+	for _, v := range s {
+		if v.Key == "" || strings.ContainsAny(v.Key, special) {
+			return fmt.Errorf("invalid character in key %q", v.Key)
+		}
+		if v.Map != nil {
+			if err := v.Map.validate(depth + 1); err != nil {
+				return err
+			}
+		} else if strings.ContainsAny(v.Value, special) {
+			return fmt.Errorf("invalid character in value %q", v.Value)
+		}
+	}
+	return nil
+}
+
+// errWriter is the sticky error writer from S60, in short.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (n int, err error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	n, ew.err = ew.w.Write(p)
+	return n, ew.err
+}
+
+// Encoder writes protocol messages.
+type Encoder struct {
+	w *errWriter
+}
+
+// NewEncoder creates an encoder.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: &errWriter{w: w}}
+}
+
+// fail records an error, unless there already is one.
+func (e *Encoder) fail(err error) {
+	if e.w.err == nil {
+		e.w.err = err
+	}
+}
+
+// validName checks a name for the greeting, it must be a single word.
+func validName(name string) error {
+	if name == "" || strings.ContainsAny(name, " \n\r") {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
+
+// WriteHello says hi.
+func (e *Encoder) WriteHello(name string) {
+	if err := validName(name); err != nil {
+		e.fail(err)
+		return
+	}
+	fmt.Fprintf(e.w, "HELLO %s\n", name)
+}
+
+// WritePreamble writes a line of free text.
+func (e *Encoder) WritePreamble(text string) {
+	if strings.ContainsAny(text, "\n\r") {
+		e.fail(errors.New("preamble must be a single line"))
+		return
+	}
+	fmt.Fprintf(e.w, "%s\n", text)
+}
+
+// WriteSettings writes settings.
+func (e *Encoder) WriteSettings(s Settings) {
+	if err := s.validate(0); err != nil {
+		e.fail(err)
+		return
+	}
+	fmt.Fprintf(e.w, "%s\n", s)
+}
+
+// WriteOK signals a successful handshake.
+func (e *Encoder) WriteOK() {
+	io.WriteString(e.w, "OK\n")
+}
+
+// Err returns the first error.
+func (e *Encoder) Err() error {
+	return e.w.err
+}
+
+// SyntaxError reports a malformed message.
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Decoder reads protocol messages from a stream, one line at a time.
+type Decoder struct {
+	br   *bufio.Reader
+	line int
+}
+
+// NewDecoder creates a decoder.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{br: bufio.NewReader(r)}
+}
+
+// readLine returns the next line without the newline.
+func (d *Decoder) readLine() (string, error) {
+	s, err := d.br.ReadString('\n')
+	if err == io.EOF && s != "" {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	d.line++
+	return strings.TrimRight(s, "\r\n"), nil
+}
+
+// ReadHello reads the greeting and returns the name.
+func (d *Decoder) ReadHello() (string, error) {
+	s, err := d.readLine()
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(s, "HELLO ") {
+		return "", &SyntaxError{Line: d.line, Msg: fmt.Sprintf("expected HELLO, got %q", s)}
+	}
+	name := s[len("HELLO "):]
+	if err := validName(name); err != nil {
+		return "", &SyntaxError{Line: d.line, Msg: err.Error()}
+	}
+	return name, nil
+}
+
+// ReadPreamble reads a line of free text.
+func (d *Decoder) ReadPreamble() (string, error) {
+	return d.readLine()
+}
+
+// ReadSettings reads and parses a settings line. Empty settings are returned
+// as nil, the encoder writes nil and empty settings alike.
+func (d *Decoder) ReadSettings() (Settings, error) {
+	s, err := d.readLine()
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{s: s, line: d.line}
+	settings, err := p.settings(';', 0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos])
+	}
+	if len(settings) == 0 {
+		return nil, nil
+	}
+	return settings, nil
+}
+
+// ReadOK reads the final acknowledgement.
+func (d *Decoder) ReadOK() error {
+	s, err := d.readLine()
+	if err != nil {
+		return err
+	}
+	if s != "OK" {
+		return &SyntaxError{Line: d.line, Msg: fmt.Sprintf("expected OK, got %q", s)}
+	}
+	return nil
+}
+
+// parser parses the settings grammar:
+//
+//	settings = [ setting { sep setting } ]
+//	setting  = key ":" value | key "=" "{" settings "}"
+//
+// where sep is ";" on the top level and "," in maps. Values may be empty, keys
+// may not. Empty maps are returned as empty, non-nil Settings, since a nil Map
+// marks a plain value.
+type parser struct {
+	s    string
+	pos  int
+	line int
+}
+
+func (p *parser) errorf(format string, a ...interface{}) error {
+	return &SyntaxError{Line: p.line, Msg: fmt.Sprintf(format, a...) + fmt.Sprintf(" at column %d", p.pos+1)}
+}
+
+// token reads up to the next special character.
+func (p *parser) token() string {
+	start := p.pos
+	for p.pos < len(p.s) && !strings.ContainsRune(special, rune(p.s[p.pos])) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *parser) settings(sep byte, depth int) (Settings, error) {
+	if depth > maxDepth {
+		return nil, p.errorf("maps nested too deeply")
+	}
+	result := Settings{}
+	if p.pos == len(p.s) || p.s[p.pos] == '}' {
+		return result, nil
+	}
+	for {
+		key := p.token()
+		if key == "" {
+			return nil, p.errorf("expected key")
+		}
+		if p.pos == len(p.s) {
+			return nil, p.errorf("expected ':' or '=' after key %q", key)
+		}
+		switch p.s[p.pos] {
+		case ':':
+			p.pos++
+			result = append(result, Setting{Key: key, Value: p.token()})
+		case '=':
+			p.pos++
+			if p.pos == len(p.s) || p.s[p.pos] != '{' {
+				return nil, p.errorf("expected '{'")
+			}
+			p.pos++
+			m, err := p.settings(',', depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if p.pos == len(p.s) || p.s[p.pos] != '}' {
+				return nil, p.errorf("expected '}'")
+			}
+			p.pos++
+			result = append(result, Setting{Key: key, Map: m})
+		default:
+			return nil, p.errorf("expected ':' or '=' after key %q", key)
+		}
+		if p.pos == len(p.s) || p.s[p.pos] != sep {
+			return result, nil
+		}
+		p.pos++
+	}
+}
+
+// Handshake is everything a client sends.
+type Handshake struct {
+	Name     string
+	Preamble string
+	Settings Settings
+}
+
+// Encode writes a complete handshake.
+func (h *Handshake) Encode(w io.Writer) error {
+	enc := NewEncoder(w)
+	enc.WriteHello(h.Name)
+	enc.WritePreamble(h.Preamble)
+	enc.WriteSettings(h.Settings)
+	enc.WriteOK()
+	return enc.Err()
+}
+
+// Decode reads a complete handshake.
+func (h *Handshake) Decode(r io.Reader) (err error) {
+	dec := NewDecoder(r)
+	if h.Name, err = dec.ReadHello(); err != nil {
+		return err
+	}
+	if h.Preamble, err = dec.ReadPreamble(); err != nil {
+		return err
+	}
+	if h.Settings, err = dec.ReadSettings(); err != nil {
+		return err
+	}
+	return dec.ReadOK()
+}
+
+func main() {
+	h := Handshake{
+		Name:     "Alice",
+		Preamble: "Protocols often consist of various steps. Some are more chatty than others.",
+		Settings: Settings{
+			{Key: "mtu", Value: "1500"},
+			{Key: "favorites", Map: Settings{
+				{Key: "color", Value: "green"},
+				{Key: "dessert", Value: "tiramisu"},
+			}},
+		},
+	}
+	var buf bytes.Buffer
+	if err := h.Encode(io.MultiWriter(&buf, os.Stdout)); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println()
+
+	var got Handshake
+	if err := got.Decode(&buf); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("hello: %s\n", got.Name)
+	fmt.Printf("preamble: %s\n", got.Preamble)
+	fmt.Printf("settings: %s\n", got.Settings)
+	dessert, _ := got.Settings.Sub("favorites").Get("dessert")
+	fmt.Printf("favorite dessert: %s\n", dessert)
+	fmt.Printf("round trip ok: %v\n", reflect.DeepEqual(h, got))
+
+	// Edge cases of the grammar survive a round trip, too.
+	cases := []Settings{
+		nil,
+		{{Key: "empty", Value: ""}},
+		{{Key: "m", Map: Settings{}}},
+		{{Key: "a", Value: ""}, {Key: "m", Map: Settings{}}, {Key: "b", Value: ""}},
+		{{Key: "m", Map: Settings{{Key: "x", Value: ""}, {Key: "n", Map: Settings{}}}}},
+		{{Key: "a", Map: Settings{{Key: "b", Map: Settings{{Key: "c", Map: Settings{{Key: "d", Value: "1"}}}}}}}},
+	}
+	for _, s := range cases {
+		want := Handshake{Name: "Alice", Settings: s}
+		buf.Reset()
+		if err := want.Encode(&buf); err != nil {
+			log.Fatal(err)
+		}
+		var got Handshake
+		if err := got.Decode(&buf); err != nil {
+			log.Fatalf("%q: %v", s, err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			log.Fatalf("round trip: got %q, want %q", got.Settings, s)
+		}
+	}
+	fmt.Printf("round trip of %d edge cases ok\n", len(cases))
+
+	// Malformed input is reported with a position.
+	bad := "HELLO Bob\nHi.\nmtu=1500\nOK\n"
+	if err := got.Decode(strings.NewReader(bad)); err != nil {
+		log.Print(err)
+	}
+	// The decoder accepts only names, the encoder would write.
+	if err := got.Decode(strings.NewReader("HELLO Bob Smith\n")); err != nil {
+		log.Print(err)
+	}
+	// Values that would break the grammar are rejected before writing.
+	h.Settings[1].Map[0].Value = "green;blue"
+	if err := h.Encode(ioutil.Discard); err != nil {
+		log.Print(err)
+	}
+}
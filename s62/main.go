@@ -0,0 +1,383 @@
+// S62: Run the protocol from S45 between a client and a server, in memory.
+//
+// The client says hello, writes the preamble and the settings, the server
+// answers with OK. Both run over net.Pipe or a loopback TCP connection, so no
+// real network is needed. A FlakyWriter can be put into either direction.
+//
+// When one side fails, the harness closes the connection and records the
+// cause, much like CloseWithError on an io.Pipe. Each side reports its own
+// error and the shared cause. A check then makes sure, that the peer of a
+// failing side saw an error, too, and that each error is one the harness can
+// explain: an injected fault, a deadline or a closed connection.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     pipe      ok                  server got Alice, mtu:1500;favorites={color:green,dessert:tiramisu}
+//     loopback  ok                  server got Alice, mtu:1500;favorites={color:green,dessert:tiramisu}
+//     pipe      flaky client        client: hello: writing failed for some reason
+//                                   server: hello: io: read/write on closed pipe (cause: writing failed for some reason)
+//     pipe      flaky server        client: ok: io: read/write on closed pipe (cause: writing failed for some reason)
+//                                   server: ok: writing failed for some reason
+//     pipe      slow server         client timed out, server found the connection closed
+//     loopback  slow server         client timed out, server found the connection closed
+//     pipe      random faults       200 runs, 112 failed, all checked
+//     loopback  random faults       200 runs, 112 failed, all checked
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FlakyWriter returns an error with probability P, like in S45, but draws
+// from its own random source, so runs are repeatable.
+type FlakyWriter struct {
+	W    io.Writer
+	P    float64
+	Rand *rand.Rand
+}
+
+// Write will fail with a given probability.
+func (w *FlakyWriter) Write(p []byte) (n int, err error) {
+	if w.Rand.Float64() < w.P {
+		return 0, ErrFlaky
+	}
+	return w.W.Write(p)
+}
+
+// ErrFlaky is returned by a failing FlakyWriter.
+var ErrFlaky = errors.New("writing failed for some reason")
+
+// stepWriter is a sticky error writer, that remembers the protocol step, in
+// which the first error happened.
+type stepWriter struct {
+	w      io.Writer
+	step   string
+	failed string
+	err    error
+}
+
+func (sw *stepWriter) Write(p []byte) (n int, err error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	n, sw.err = sw.w.Write(p)
+	if sw.err != nil {
+		sw.failed = sw.step
+	}
+	return n, sw.err
+}
+
+// HandshakeError tells, which side failed in which step. Err is the error
+// this side saw, Cause is the first failure of either side.
+type HandshakeError struct {
+	Side  string
+	Step  string
+	Err   error
+	Cause error
+}
+
+func (e *HandshakeError) Error() string {
+	if e.Cause == e.Err {
+		return fmt.Sprintf("%s: %s: %v", e.Side, e.Step, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v (cause: %v)", e.Side, e.Step, e.Err, e.Cause)
+}
+
+func (e *HandshakeError) Unwrap() error { return e.Err }
+
+// Transport creates a connected pair of connections.
+type Transport func() (client, server net.Conn, err error)
+
+// Pipe is a synchronous, in-memory transport.
+func Pipe() (client, server net.Conn, err error) {
+	client, server = net.Pipe()
+	return client, server, nil
+}
+
+// Loopback connects over TCP on 127.0.0.1.
+func Loopback() (client, server net.Conn, err error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			conn = nil
+		}
+		accepted <- conn
+	}()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	if server = <-accepted; server == nil {
+		client.Close()
+		return nil, nil, errors.New("accept failed")
+	}
+	return client, server, nil
+}
+
+// Harness runs a single handshake.
+type Harness struct {
+	Transport Transport
+	// ClientWriter and ServerWriter, if not nil, wrap the writing side of
+	// each connection, e.g. to inject faults.
+	ClientWriter func(io.Writer) io.Writer
+	ServerWriter func(io.Writer) io.Writer
+	// Timeout for the whole handshake, zero means no timeout.
+	Timeout time.Duration
+	// ServerDelay lets the server stall before it answers.
+	ServerDelay time.Duration
+
+	mu    sync.Mutex
+	cause error
+	conns []net.Conn
+}
+
+// Result is what both sides report.
+type Result struct {
+	Name     string // the name the server got
+	Settings string // the settings the server got
+	Client   error
+	Server   error
+}
+
+// closed reports, whether err comes from a connection closed on either end.
+func closed(err error) bool {
+	for _, target := range []error{io.EOF, io.ErrClosedPipe, net.ErrClosed, syscall.ECONNRESET, syscall.EPIPE} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// explained reports, whether the harness can cause err: an injected fault, a
+// deadline or a closed connection.
+func explained(err error) bool {
+	return errors.Is(err, ErrFlaky) || errors.Is(err, os.ErrDeadlineExceeded) || closed(err)
+}
+
+// Check returns an error, if only one side failed, if the sides disagree on
+// the cause, or if a side saw an error the harness cannot explain.
+func (r Result) Check() error {
+	if r.Client == nil && r.Server == nil {
+		return nil
+	}
+	var c, s *HandshakeError
+	if !errors.As(r.Client, &c) || !errors.As(r.Server, &s) {
+		return fmt.Errorf("only one side failed: client: %v, server: %v", r.Client, r.Server)
+	}
+	if c.Cause != s.Cause {
+		return fmt.Errorf("different causes: %v, %v", c.Cause, s.Cause)
+	}
+	if c.Err != c.Cause && s.Err != s.Cause {
+		return fmt.Errorf("no side saw the cause: %v, %v", c, s)
+	}
+	for _, e := range []*HandshakeError{c, s} {
+		if !explained(e.Err) {
+			return fmt.Errorf("unexpected error: %v", e)
+		}
+	}
+	return nil
+}
+
+// fail records the first cause and closes the connection, so the other side
+// stops waiting. It returns the error of this side, with the cause.
+func (h *Harness) fail(side, step string, err error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cause == nil {
+		h.cause = err
+		for _, c := range h.conns {
+			c.Close()
+		}
+	}
+	return &HandshakeError{Side: side, Step: step, Err: err, Cause: h.cause}
+}
+
+// Run performs the handshake, with the client greeting as name.
+func (h *Harness) Run(name string) (Result, error) {
+	client, server, err := h.Transport()
+	if err != nil {
+		return Result{}, err
+	}
+	defer client.Close()
+	defer server.Close()
+	h.cause, h.conns = nil, []net.Conn{client, server}
+	if h.Timeout > 0 {
+		deadline := time.Now().Add(h.Timeout)
+		client.SetDeadline(deadline)
+		server.SetDeadline(deadline)
+	}
+	var (
+		result Result
+		wg     sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		result.Name, result.Settings, result.Server = h.serve(server)
+	}()
+	result.Client = h.greet(client, name)
+	wg.Wait()
+	return result, nil
+}
+
+func wrap(f func(io.Writer) io.Writer, w io.Writer) io.Writer {
+	if f == nil {
+		return w
+	}
+	return f(w)
+}
+
+// greet is the client side.
+func (h *Harness) greet(conn net.Conn, name string) error {
+	sw := &stepWriter{w: wrap(h.ClientWriter, conn)}
+	sw.step = "hello"
+	fmt.Fprintf(sw, "HELLO %s\n", name)
+	sw.step = "preamble"
+	io.WriteString(sw, "Protocols often consist of various steps. Some are more chatty than others.\n")
+	sw.step = "settings"
+	fmt.Fprintf(sw, "mtu:%d;favorites={color:%s,dessert:%s}\n", 1500, "green", "tiramisu")
+	if sw.err != nil {
+		return h.fail("client", sw.failed, sw.err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err == nil && line != "OK\n" {
+		err = fmt.Errorf("expected OK, got %q", line)
+	}
+	if err != nil {
+		return h.fail("client", "ok", err)
+	}
+	return nil
+}
+
+// serve is the server side. It returns the name and settings of the client.
+func (h *Harness) serve(conn net.Conn) (name, settings string, err error) {
+	br := bufio.NewReader(conn)
+	var lines [3]string
+	for i, step := range []string{"hello", "preamble", "settings"} {
+		line, err := br.ReadString('\n')
+		if err == nil && i == 0 && !strings.HasPrefix(line, "HELLO ") {
+			err = fmt.Errorf("expected HELLO, got %q", line)
+		}
+		if err != nil {
+			return "", "", h.fail("server", step, err)
+		}
+		lines[i] = strings.TrimSuffix(line, "\n")
+	}
+	name, settings = strings.TrimPrefix(lines[0], "HELLO "), lines[2]
+	time.Sleep(h.ServerDelay)
+	if _, err := io.WriteString(wrap(h.ServerWriter, conn), "OK\n"); err != nil {
+		return "", "", h.fail("server", "ok", err)
+	}
+	return name, settings, nil
+}
+
+// flaky returns a wrapper for a connection, that fails with probability p.
+func flaky(p float64, rnd *rand.Rand) func(io.Writer) io.Writer {
+	return func(w io.Writer) io.Writer {
+		return &FlakyWriter{W: w, P: p, Rand: rnd}
+	}
+}
+
+// show runs a single handshake and prints the outcome.
+func show(transport, label string, h *Harness) {
+	r, err := h.Run("Alice")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := r.Check(); err != nil {
+		log.Fatalf("%s: %v", label, err)
+	}
+	prefix := fmt.Sprintf("%-10s%-20s", transport, label)
+	if r.Client == nil {
+		fmt.Printf("%sserver got %s, %s\n", prefix, r.Name, r.Settings)
+		return
+	}
+	fmt.Printf("%s%v\n%30s%v\n", prefix, r.Client, "", r.Server)
+}
+
+// stress runs many handshakes with faults in both directions.
+func stress(transport string, t Transport) {
+	h := &Harness{
+		Transport:    t,
+		ClientWriter: flaky(0.1, rand.New(rand.NewSource(1))),
+		ServerWriter: flaky(0.3, rand.New(rand.NewSource(2))),
+		Timeout:      time.Second,
+	}
+	var runs, failed int
+	for i := 0; i < 200; i++ {
+		r, err := h.Run("Alice")
+		if err != nil {
+			log.Fatal(err)
+		}
+		runs++
+		if r.Client == nil {
+			continue
+		}
+		failed++
+		if err := r.Check(); err != nil {
+			log.Fatal(err)
+		}
+		// The only faults are injected ones.
+		var e *HandshakeError
+		if errors.As(r.Client, &e); e.Cause != ErrFlaky {
+			log.Fatalf("unexpected cause: %v", e.Cause)
+		}
+	}
+	fmt.Printf("%-10s%-20s%d runs, %d failed, all checked\n",
+		transport, "random faults", runs, failed)
+}
+
+func main() {
+	show("pipe", "ok", &Harness{Transport: Pipe})
+	show("loopback", "ok", &Harness{Transport: Loopback})
+
+	rnd := rand.New(rand.NewSource(1))
+	show("pipe", "flaky client", &Harness{Transport: Pipe, ClientWriter: flaky(1, rnd)})
+	show("pipe", "flaky server", &Harness{Transport: Pipe, ServerWriter: flaky(1, rnd)})
+
+	// A server, that does not answer in time, makes the client time out. The
+	// server then finds the connection closed.
+	for _, t := range []struct {
+		name      string
+		transport Transport
+	}{
+		{"pipe", Pipe},
+		{"loopback", Loopback},
+	} {
+		h := &Harness{Transport: t.transport, Timeout: 50 * time.Millisecond, ServerDelay: 100 * time.Millisecond}
+		r, err := h.Run("Alice")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := r.Check(); err != nil {
+			log.Fatal(err)
+		}
+		if !errors.Is(r.Client, os.ErrDeadlineExceeded) || !closed(r.Server) {
+			log.Fatalf("expected a timeout and a closed connection, got %v, %v", r.Client, r.Server)
+		}
+		fmt.Printf("%-10s%-20sclient timed out, server found the connection closed\n", t.name, "slow server")
+	}
+
+	stress("pipe", Pipe)
+	stress("loopback", Loopback)
+}
@@ -0,0 +1,275 @@
+// S63: Normalize line endings, BOM and trailing whitespace, while reading.
+//
+// Text files come with a byte order mark, CRLF or even CR line endings,
+// trailing whitespace or without a final newline. The reader here fixes all of
+// that on the fly, with each fix being optional.
+//
+// Compared to the finalNewlineReader from S46, it does not add a newline
+// twice, when the last read ended with a newline and the next one returns 0,
+// io.EOF. It does not loop forever either: after the end of the stream, each
+// call returns io.EOF, also for an empty p.
+//
+// A CR at the end of one read and a LF at the start of the next are still a
+// single line ending. A BOM split across reads is still removed.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     "a,b\r\nc,d"                 -> "a,b\nc,d\n"
+//     "\ufeffid\tname\r\n1\tx\r\n" -> "id\tname\n1\tx\n"
+//     "old mac\rline\r"            -> "old mac\nline\n"
+//     "trailing \t\nspace  "       -> "trailing\nspace\n"
+//     "already fine\n"             -> "already fine\n"
+//     ""                           -> ""
+//     after EOF: 0 EOF
+//     10000 random inputs, byte by byte and in random chunks: ok
+//
+//     $ printf '\xef\xbb\xbfone \r\ntwo' | go run main.go -
+//     one
+//     two
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"testing/iotest"
+)
+
+// Options select the normalizations. The zero value changes nothing.
+type Options struct {
+	FinalNewline bool // append a newline, if the last line lacks one
+	LineEndings  bool // convert CRLF and CR to LF
+	StripBOM     bool // remove a leading UTF-8 byte order mark
+	TrimSpace    bool // remove spaces and tabs at the end of each line
+}
+
+// All enables all normalizations.
+var All = Options{FinalNewline: true, LineEndings: true, StripBOM: true, TrimSpace: true}
+
+var bom = []byte("\xef\xbb\xbf")
+
+// Reader normalizes text from an underlying reader.
+type Reader struct {
+	r    io.Reader
+	opts Options
+	buf  []byte
+	out  []byte // normalized, unread bytes
+	err  error
+
+	head    []byte // first bytes, while looking for a BOM
+	started bool   // true, once the BOM check is done
+	cr      bool   // last byte was a CR, which has been turned into LF
+	space   []byte // trailing whitespace, held back until we know what follows
+	last    byte   // last byte emitted
+	any     bool   // true, if any byte has been emitted
+}
+
+// NewReader returns a reader, that normalizes r according to opts.
+func NewReader(r io.Reader, opts Options) *Reader {
+	return &Reader{r: r, opts: opts, buf: make([]byte, 4096)}
+}
+
+// Read reads normalized bytes.
+func (r *Reader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		if len(r.out) == 0 && r.err != nil {
+			return 0, r.err
+		}
+		return 0, nil
+	}
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+	n = copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fill reads from the underlying reader and normalizes, what it got.
+func (r *Reader) fill() {
+	n, err := r.r.Read(r.buf)
+	data := r.buf[:n]
+	if !r.started && r.opts.StripBOM {
+		r.head = append(r.head, data...)
+		if err == nil && len(r.head) < len(bom) && bytes.HasPrefix(bom, r.head) {
+			return // could still be a BOM
+		}
+		data = bytes.TrimPrefix(r.head, bom)
+	}
+	r.started = true
+	r.out = r.out[:0]
+	r.normalize(data)
+	if err != nil {
+		if err == io.EOF {
+			r.finish()
+		}
+		r.err = err
+	}
+}
+
+func (r *Reader) emit(c byte) {
+	r.out = append(r.out, c)
+	r.last, r.any = c, true
+}
+
+// normalize appends the normalized bytes of b to out.
+func (r *Reader) normalize(b []byte) {
+	for _, c := range b {
+		if r.opts.LineEndings {
+			if r.cr && c == '\n' {
+				r.cr = false
+				continue // second half of a CRLF
+			}
+			r.cr = c == '\r'
+			if c == '\r' {
+				c = '\n'
+			}
+		}
+		if r.opts.TrimSpace {
+			switch c {
+			case ' ', '\t':
+				r.space = append(r.space, c)
+				continue
+			case '\n':
+				r.space = r.space[:0]
+			default:
+				for _, s := range r.space {
+					r.emit(s)
+				}
+				r.space = r.space[:0]
+			}
+		}
+		r.emit(c)
+	}
+}
+
+// finish handles the end of the stream. Whitespace still held back is at the
+// end of the last line and is dropped.
+func (r *Reader) finish() {
+	if !r.opts.TrimSpace {
+		for _, s := range r.space {
+			r.emit(s)
+		}
+	}
+	r.space = nil
+	if r.opts.FinalNewline && r.any && r.last != '\n' {
+		r.emit('\n')
+	}
+}
+
+// normalize is a reference implementation, working on the whole input at once.
+func normalize(s string, o Options) string {
+	if o.StripBOM {
+		s = strings.TrimPrefix(s, string(bom))
+	}
+	if o.LineEndings {
+		s = strings.ReplaceAll(s, "\r\n", "\n")
+		s = strings.ReplaceAll(s, "\r", "\n")
+	}
+	if o.TrimSpace {
+		lines := strings.Split(s, "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(line, " \t")
+		}
+		s = strings.Join(lines, "\n")
+	}
+	if o.FinalNewline && s != "" && !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	return s
+}
+
+// chunkReader returns data in chunks of random size, including empty ones.
+type chunkReader struct {
+	r    io.Reader
+	rand *rand.Rand
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if k := r.rand.Intn(5); k < len(p) {
+		p = p[:k]
+	}
+	return r.r.Read(p)
+}
+
+// randomText draws from characters, that are likely to trip a normalizer.
+func randomText(rnd *rand.Rand) string {
+	parts := []string{"\r", "\n", "\r\n", " ", "\t", "a", "b", "\xef", "\xbb", "\xbf", string(bom)}
+	var sb strings.Builder
+	for i := rnd.Intn(12); i > 0; i-- {
+		sb.WriteString(parts[rnd.Intn(len(parts))])
+	}
+	return sb.String()
+}
+
+// conformance compares the reader with the reference implementation.
+func conformance(n int) error {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		s := randomText(rnd)
+		var o Options
+		o.FinalNewline, o.LineEndings = rnd.Intn(2) == 0, rnd.Intn(2) == 0
+		o.StripBOM, o.TrimSpace = rnd.Intn(2) == 0, rnd.Intn(2) == 0
+		want := normalize(s, o)
+		for _, r := range []io.Reader{
+			iotest.OneByteReader(strings.NewReader(s)),
+			&chunkReader{r: strings.NewReader(s), rand: rnd},
+			iotest.DataErrReader(strings.NewReader(s)),
+		} {
+			b, err := ioutil.ReadAll(NewReader(r, o))
+			if err != nil {
+				return err
+			}
+			if string(b) != want {
+				return fmt.Errorf("%q with %+v: got %q, want %q", s, o, b, want)
+			}
+		}
+		if err := iotest.TestReader(NewReader(strings.NewReader(s), o), []byte(want)); err != nil {
+			return fmt.Errorf("%q with %+v: %v", s, o, err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "-" {
+		if _, err := io.Copy(os.Stdout, NewReader(os.Stdin, All)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	for _, s := range []string{
+		"a,b\r\nc,d",
+		"\ufeffid\tname\r\n1\tx\r\n",
+		"old mac\rline\r",
+		"trailing \t\nspace  ",
+		"already fine\n",
+		"",
+	} {
+		b, err := ioutil.ReadAll(NewReader(strings.NewReader(s), All))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%-28s -> %q\n", fmt.Sprintf("%+q", s), b)
+	}
+
+	r := NewReader(strings.NewReader("x"), All)
+	ioutil.ReadAll(r)
+	n, err := r.Read(nil)
+	fmt.Printf("after EOF: %d %v\n", n, err)
+
+	if err := conformance(10000); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("10000 random inputs, byte by byte and in random chunks: ok")
+}
@@ -0,0 +1,246 @@
+// S64: A reader, that switches between any number of sources.
+//
+// The ToggleReader from S47 embeds a *bufio.Reader, so ReadString and friends
+// never take the mutex, that Toggle locks. Switching while another goroutine
+// reads is a data race. Here, every read method holds the lock, so a switch
+// happens between two reads, never during one. A switch waits for a read in
+// progress, so a source, that blocks, blocks switching, too.
+//
+// OnEOF is called once per source, when it is exhausted. It is called without
+// the lock held, so it may call Next or Switch.
+//
+// OUTPUT:
+//
+//     $ go run -race main.go
+//     A
+//     1
+//     B
+//     2
+//     C
+//     3
+//     source 0 done
+//     4
+//     5
+//     source 1 done
+//     concurrent: 3000 lines, 0 torn, 1000 switches
+//     switch to 7: switch: no source 7
+//     no sources: EOF, next: false
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+// SwitchReader reads from one of several sources at a time.
+type SwitchReader struct {
+	// OnEOF, if not nil, is called with the index of a source, that returned
+	// io.EOF for the first time. Set it before reading.
+	OnEOF func(i int)
+
+	mu  sync.Mutex
+	rs  []*bufio.Reader
+	eof []bool
+	cur int
+}
+
+// NewSwitchReader creates a reader, that starts with the first source. Without
+// sources, every read returns io.EOF.
+func NewSwitchReader(rs ...io.Reader) *SwitchReader {
+	sr := &SwitchReader{eof: make([]bool, len(rs))}
+	for _, r := range rs {
+		sr.rs = append(sr.rs, bufio.NewReader(r))
+	}
+	return sr
+}
+
+// Switch makes source i the current source.
+func (r *SwitchReader) Switch(i int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i < 0 || i >= len(r.rs) {
+		return fmt.Errorf("switch: no source %d", i)
+	}
+	r.cur = i
+	return nil
+}
+
+// Next switches to the next source, that is not exhausted, in round robin
+// order. It returns the new index and false, if all sources are exhausted.
+func (r *SwitchReader) Next() (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k := 1; k <= len(r.rs); k++ {
+		i := (r.cur + k) % len(r.rs)
+		if !r.eof[i] {
+			r.cur = i
+			return i, true
+		}
+	}
+	return r.cur, false
+}
+
+// Current returns the index of the current source.
+func (r *SwitchReader) Current() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cur
+}
+
+// Done reports, whether all sources are exhausted.
+func (r *SwitchReader) Done() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, done := range r.eof {
+		if !done {
+			return false
+		}
+	}
+	return true
+}
+
+// do runs f on the current source with the lock held and notifies about EOF
+// after releasing it.
+func (r *SwitchReader) do(f func(br *bufio.Reader) error) {
+	r.mu.Lock()
+	if len(r.rs) == 0 {
+		r.mu.Unlock()
+		f(bufio.NewReaderSize(strings.NewReader(""), 16))
+		return
+	}
+	i := r.cur
+	err := f(r.rs[i])
+	first := err == io.EOF && !r.eof[i]
+	if first {
+		r.eof[i] = true
+	}
+	r.mu.Unlock()
+	if first && r.OnEOF != nil {
+		r.OnEOF(i)
+	}
+}
+
+// Read reads from the current source.
+func (r *SwitchReader) Read(p []byte) (n int, err error) {
+	r.do(func(br *bufio.Reader) error {
+		n, err = br.Read(p)
+		return err
+	})
+	return n, err
+}
+
+// ReadByte reads a byte from the current source.
+func (r *SwitchReader) ReadByte() (c byte, err error) {
+	r.do(func(br *bufio.Reader) error {
+		c, err = br.ReadByte()
+		return err
+	})
+	return c, err
+}
+
+// ReadRune reads a rune from the current source.
+func (r *SwitchReader) ReadRune() (c rune, size int, err error) {
+	r.do(func(br *bufio.Reader) error {
+		c, size, err = br.ReadRune()
+		return err
+	})
+	return c, size, err
+}
+
+// ReadBytes reads from the current source up to and including delim.
+func (r *SwitchReader) ReadBytes(delim byte) (b []byte, err error) {
+	r.do(func(br *bufio.Reader) error {
+		b, err = br.ReadBytes(delim)
+		return err
+	})
+	return b, err
+}
+
+// ReadString reads from the current source up to and including delim.
+func (r *SwitchReader) ReadString(delim byte) (s string, err error) {
+	r.do(func(br *bufio.Reader) error {
+		s, err = br.ReadString(delim)
+		return err
+	})
+	return s, err
+}
+
+// endless returns lines like "c-0000\n", forever.
+type endless struct {
+	prefix byte
+	buf    []byte
+	i      int
+}
+
+func (r *endless) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		r.buf = []byte(fmt.Sprintf("%c-%04d\n", r.prefix, r.i%10000))
+		r.i++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// concurrent reads lines in one goroutine, while another one switches.
+func concurrent() {
+	sr := NewSwitchReader(&endless{prefix: 'a'}, &endless{prefix: 'b'}, &endless{prefix: 'c'})
+	const lines = 3000
+	const switches = 1000
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < switches; i++ {
+			sr.Next()
+		}
+	}()
+	var torn int
+	for i := 0; i < lines; i++ {
+		line, err := sr.ReadString('\n')
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(line) != 7 || !strings.ContainsRune("abc", rune(line[0])) || line[1] != '-' {
+			torn++
+		}
+	}
+	wg.Wait()
+	fmt.Printf("concurrent: %d lines, %d torn, %d switches\n", lines, torn, switches)
+}
+
+func main() {
+	// Like S47, alternating while both sources have lines.
+	sr := NewSwitchReader(strings.NewReader("A\nB\nC\n"), strings.NewReader("1\n2\n3\n4\n5\n"))
+	sr.OnEOF = func(i int) { fmt.Printf("source %d done\n", i) }
+	for {
+		line, err := sr.ReadString('\n')
+		if err == io.EOF {
+			if _, ok := sr.Next(); !ok {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(line)
+		sr.Next()
+	}
+
+	concurrent()
+
+	if err := sr.Switch(7); err != nil {
+		fmt.Printf("switch to 7: %v\n", err)
+	}
+
+	none := NewSwitchReader()
+	_, err := none.ReadString('\n')
+	_, ok := none.Next()
+	fmt.Printf("no sources: %v, next: %v\n", err, ok)
+}
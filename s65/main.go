@@ -0,0 +1,261 @@
+// S65: Fail over from a primary source to backups, without losing data.
+//
+// The reader counts the bytes it has returned. When the current source fails
+// or stalls, it moves on to the next source and resumes at that offset. A
+// source is a function, that opens a stream at a given offset. Seeker adapts
+// an io.ReadSeeker, Discard a stream, that can only be read from the start.
+//
+// Stalls are detected with a timeout, like in S27b. The read of a stalled
+// source goes into a private buffer, so it cannot write into p after Read has
+// returned. A stalled source is closed, if it is an io.Closer.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     failover 0 -> 1 at offset 3000: connection reset by peer
+//     failover 1 -> 2 at offset 6000: source stalled
+//     shipped 12890 bytes, identical: true
+//     failover 0 -> 1 at offset 3000: connection reset by peer
+//     error: all sources failed: source 1 at offset 3000: seek before start
+//     error: no sources
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+// ErrStalled is returned for a source, that did not answer in time.
+var ErrStalled = errors.New("source stalled")
+
+// ErrNoSources is returned by a reader without any source.
+var ErrNoSources = errors.New("no sources")
+
+// Source opens a stream, that starts at the given offset.
+type Source func(off int64) (io.Reader, error)
+
+// Seeker resumes by seeking.
+func Seeker(rs io.ReadSeeker) Source {
+	return func(off int64) (io.Reader, error) {
+		if _, err := rs.Seek(off, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return rs, nil
+	}
+}
+
+// Discard resumes a stream, that starts at offset zero, by reading and
+// throwing away the first off bytes. It can only be opened once.
+func Discard(r io.Reader) Source {
+	return func(off int64) (io.Reader, error) {
+		if _, err := io.CopyN(ioutil.Discard, r, off); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+}
+
+// SourceError records, which source failed at which offset.
+type SourceError struct {
+	Source int
+	Offset int64
+	Err    error
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("source %d at offset %d: %v", e.Source, e.Offset, e.Err)
+}
+
+func (e *SourceError) Unwrap() error { return e.Err }
+
+// FailoverReader reads from the first source, that works.
+type FailoverReader struct {
+	// Timeout for a single read, zero means wait forever.
+	Timeout time.Duration
+	// OnFailover, if not nil, is called when switching sources.
+	OnFailover func(from, to int, off int64, err error)
+
+	sources []Source
+	cur     int
+	r       io.Reader // current stream, nil if not opened yet
+	off     int64     // bytes returned so far
+	failed  error     // error of the current source, not yet acted upon
+}
+
+// NewFailoverReader creates a reader, that tries sources in order.
+func NewFailoverReader(sources ...Source) *FailoverReader {
+	return &FailoverReader{sources: sources}
+}
+
+// Read reads from the current source. Errors other than io.EOF make the
+// reader move on to the next source. If all sources fail, the error of the
+// last one is returned.
+func (r *FailoverReader) Read(p []byte) (n int, err error) {
+	if len(r.sources) == 0 {
+		return 0, ErrNoSources
+	}
+	for {
+		if r.failed != nil {
+			if err := r.failover(); err != nil {
+				return 0, err
+			}
+		}
+		if r.r == nil {
+			if r.r, err = r.sources[r.cur](r.off); err != nil {
+				r.r, r.failed = nil, err
+				continue
+			}
+		}
+		n, err = r.read(p)
+		r.off += int64(n)
+		switch {
+		case err == nil || err == io.EOF:
+			return n, err
+		case n > 0:
+			r.failed = err
+			return n, nil
+		default:
+			r.failed = err
+		}
+	}
+}
+
+// failover moves on to the next source.
+func (r *FailoverReader) failover() error {
+	err := &SourceError{Source: r.cur, Offset: r.off, Err: r.failed}
+	if c, ok := r.r.(io.Closer); ok {
+		c.Close()
+	}
+	r.r, r.failed = nil, nil
+	if r.cur+1 == len(r.sources) {
+		return fmt.Errorf("all sources failed: %w", err)
+	}
+	if r.OnFailover != nil {
+		r.OnFailover(r.cur, r.cur+1, r.off, err.Err)
+	}
+	r.cur++
+	return nil
+}
+
+// read reads from the current stream, with a timeout.
+func (r *FailoverReader) read(p []byte) (int, error) {
+	if r.Timeout == 0 {
+		return r.r.Read(p)
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	var (
+		buf = make([]byte, len(p))
+		ch  = make(chan result, 1)
+		rd  = r.r
+	)
+	go func() {
+		n, err := rd.Read(buf)
+		ch <- result{n, err}
+	}()
+	select {
+	case res := <-ch:
+		return copy(p, buf[:res.n]), res.err
+	case <-time.After(r.Timeout):
+		return 0, ErrStalled
+	}
+}
+
+// failing fails after a number of bytes, like a dropped connection.
+type failing struct {
+	*bytes.Reader
+	limit int64
+}
+
+func (r *failing) Read(p []byte) (int, error) {
+	pos := r.Size() - int64(r.Len())
+	if pos >= r.limit {
+		return 0, errors.New("connection reset by peer")
+	}
+	if rest := r.limit - pos; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	return r.Reader.Read(p)
+}
+
+// stalling blocks after a number of bytes, until it is closed.
+type stalling struct {
+	*bytes.Reader
+	limit  int64
+	closed chan struct{}
+}
+
+func (r *stalling) Read(p []byte) (int, error) {
+	pos := r.Size() - int64(r.Len())
+	if pos >= r.limit {
+		<-r.closed
+		return 0, errors.New("closed")
+	}
+	if rest := r.limit - pos; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	return r.Reader.Read(p)
+}
+
+func (r *stalling) Close() error {
+	close(r.closed)
+	return nil
+}
+
+func main() {
+	var sb strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&sb, "log line %d\n", i)
+	}
+	data := sb.String()
+
+	logFailover := func(from, to int, off int64, err error) {
+		fmt.Printf("failover %d -> %d at offset %d: %v\n", from, to, off, err)
+	}
+
+	// The main endpoint drops the connection, the first mirror stalls, the
+	// second mirror cannot seek.
+	r := NewFailoverReader(
+		Seeker(&failing{Reader: bytes.NewReader([]byte(data)), limit: 3000}),
+		Seeker(&stalling{Reader: bytes.NewReader([]byte(data)), limit: 6000, closed: make(chan struct{})}),
+		Discard(strings.NewReader(data)),
+	)
+	r.Timeout = 100 * time.Millisecond
+	r.OnFailover = logFailover
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("shipped %d bytes, identical: %v\n", n, buf.String() == data)
+
+	// A source, that cannot resume, is an error, too.
+	r = NewFailoverReader(
+		Seeker(&failing{Reader: bytes.NewReader([]byte(data)), limit: 3000}),
+		func(off int64) (io.Reader, error) {
+			if off > 0 {
+				return nil, errors.New("seek before start")
+			}
+			return strings.NewReader(data), nil
+		},
+	)
+	r.OnFailover = logFailover
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+
+	// So is a reader without sources.
+	if _, err := io.Copy(ioutil.Discard, NewFailoverReader()); err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+}
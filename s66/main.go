@@ -0,0 +1,401 @@
+// S66: Upper, lower and title case, streaming and with full Unicode mappings.
+//
+// A naive UpperReader (S21) calls bytes.ToUpper on whatever a read returns.
+// That breaks, when a multi-byte rune is split across two reads. And the
+// output can have another length than the input: "ı" is two bytes, "I" is
+// one, and "ß" becomes "SS" with full case mapping.
+//
+// The readers and writers here carry an incomplete rune over to the next
+// call. They support language specific rules with unicode.SpecialCase, e.g.
+// unicode.TurkishCase, and a few full mappings from Unicode's
+// SpecialCasing.txt, where one rune maps to several. A writer returns the
+// number of bytes of p it consumed, regardless of how many bytes it wrote.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     upper:           "GRÜSSE AUS DER STRASSE, FINE → FINE"
+//     strings.ToUpper: "GRÜßE AUS DER STRAßE, ﬁNE → FINE"
+//     turkish upper:   "İSTANBUL'DA IŞIK"
+//     turkish lower:   "istanbul'da ışık"
+//     lower:           "i̇stanbul'da işik"
+//     title:           "Hello Gophers, O'neil Says ǅ Is ǅ, Not ǅ"
+//     write "ıı" = 4, wrote "II"
+//     write "iı" = 3, wrote "İI"
+//     write "ıııı" = 2 short write, wrote "I"
+//     10000 random strings, byte by byte and in random chunks: ok
+//
+//     $ echo "Hello Gophers" | go run main.go -
+//     HELLO GOPHERS
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"testing/iotest"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Case is the kind of mapping.
+type Case int
+
+const (
+	Upper Case = iota
+	Lower
+	Title // first letter of each word in title case, the rest in lower case
+)
+
+// Caser describes a case mapping.
+type Caser struct {
+	Case    Case
+	Special unicode.SpecialCase // language specific rules, may be nil
+	Full    bool                // use mappings from one rune to many
+}
+
+// full holds a few unconditional mappings from SpecialCasing.txt. Special
+// rules take precedence.
+var full = map[Case]map[rune]string{
+	Upper: {
+		'ß': "SS", 'ŉ': "ʼN", 'ǰ': "J̌", 'և': "ԵՒ",
+		'ﬀ': "FF", 'ﬁ': "FI", 'ﬂ': "FL", 'ﬃ': "FFI", 'ﬄ': "FFL", 'ﬅ': "ST", 'ﬆ': "ST",
+	},
+	Lower: {
+		'İ': "i̇",
+	},
+	Title: {
+		'ß': "Ss", 'ŉ': "ʼN", 'ǰ': "J̌", 'և': "Եւ",
+		'ﬀ': "Ff", 'ﬁ': "Fi", 'ﬂ': "Fl", 'ﬃ': "Ffi", 'ﬄ': "Ffl", 'ﬅ': "St", 'ﬆ': "St",
+	},
+}
+
+// mapper applies a Caser to a stream of runes. It keeps track of words for
+// title case.
+type mapper struct {
+	Caser
+	inWord bool
+}
+
+// special reports, whether the special case has a rule for r.
+func special(sc unicode.SpecialCase, r rune) bool {
+	for _, cr := range sc {
+		if rune(cr.Lo) <= r && r <= rune(cr.Hi) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendRune appends the mapping of r to dst.
+func (m *mapper) appendRune(dst []byte, r rune) []byte {
+	c := m.Case
+	if c == Title {
+		if m.inWord {
+			c = Lower
+		}
+		m.inWord = unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) || r == '\'' || r == '’'
+	}
+	if special(m.Special, r) {
+		switch c {
+		case Upper:
+			r = m.Special.ToUpper(r)
+		case Lower:
+			r = m.Special.ToLower(r)
+		case Title:
+			r = m.Special.ToTitle(r)
+		}
+		return utf8.AppendRune(dst, r)
+	}
+	if s, ok := full[c][r]; ok && m.Full {
+		return append(dst, s...)
+	}
+	switch c {
+	case Upper:
+		r = unicode.ToUpper(r)
+	case Lower:
+		r = unicode.ToLower(r)
+	case Title:
+		r = unicode.ToTitle(r)
+	}
+	return utf8.AppendRune(dst, r)
+}
+
+// next maps the first rune in src and appends it to dst. It returns the
+// number of bytes consumed, which is 0, if src starts with an incomplete rune
+// and more input may follow. Invalid bytes are copied as they are.
+func (m *mapper) next(dst, src []byte, atEOF bool) ([]byte, int) {
+	if !atEOF && !utf8.FullRune(src) {
+		return dst, 0
+	}
+	r, size := utf8.DecodeRune(src)
+	if r == utf8.RuneError && size == 1 {
+		m.inWord = false
+		return append(dst, src[0]), 1
+	}
+	return m.appendRune(dst, r), size
+}
+
+// transform maps as much of src as possible and returns the bytes consumed.
+func (m *mapper) transform(dst, src []byte, atEOF bool) ([]byte, int) {
+	var i int
+	for i < len(src) {
+		var k int
+		if dst, k = m.next(dst, src[i:], atEOF); k == 0 {
+			break
+		}
+		i += k
+	}
+	return dst, i
+}
+
+// String maps a whole string.
+func (c Caser) String(s string) string {
+	m := mapper{Caser: c}
+	b, _ := m.transform(nil, []byte(s), true)
+	return string(b)
+}
+
+// Reader changes the case of what it reads.
+type Reader struct {
+	r    io.Reader
+	m    mapper
+	buf  []byte
+	nc   int // bytes of an incomplete rune, at the start of buf
+	out  []byte
+	obuf []byte
+	err  error
+}
+
+// NewReader returns a reader, that changes the case of r.
+func NewReader(r io.Reader, c Caser) *Reader {
+	return &Reader{r: r, m: mapper{Caser: c}, buf: make([]byte, 4096)}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := r.r.Read(r.buf[r.nc:])
+		src := r.buf[:r.nc+n]
+		var k int
+		r.obuf, k = r.m.transform(r.obuf[:0], src, err != nil)
+		r.out = r.obuf
+		r.nc = copy(r.buf, src[k:])
+		r.err = err
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// Writer changes the case of what is written to it. Call Close to write an
+// incomplete rune at the end, if any.
+type Writer struct {
+	w     io.Writer
+	m     mapper
+	carry [utf8.UTFMax]byte
+	nc    int
+	in    []byte
+	out   []byte
+	ends  []end
+}
+
+// end records, where the mapping of a rune ends, in input and output.
+type end struct{ in, out int }
+
+// NewWriter returns a writer, that changes the case of what is written to w.
+func NewWriter(w io.Writer, c Caser) *Writer {
+	return &Writer{w: w, m: mapper{Caser: c}}
+}
+
+// Write maps p and writes the result. It returns len(p), unless the
+// underlying writer fails. Then n counts the bytes of p, whose mapping has
+// been written completely.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	carried := w.nc
+	w.in = append(append(w.in[:0], w.carry[:w.nc]...), p...)
+	w.out, w.ends = w.out[:0], w.ends[:0]
+	var i int
+	for i < len(w.in) {
+		var k int
+		if w.out, k = w.m.next(w.out, w.in[i:], false); k == 0 {
+			break
+		}
+		i += k
+		w.ends = append(w.ends, end{in: i, out: len(w.out)})
+	}
+	w.nc = copy(w.carry[:], w.in[i:])
+	written, err := w.w.Write(w.out)
+	if err == nil && written < len(w.out) {
+		err = io.ErrShortWrite
+	}
+	if err == nil {
+		return len(p), nil
+	}
+	var consumed int
+	for _, e := range w.ends {
+		if e.out > written {
+			break
+		}
+		consumed = e.in
+	}
+	if consumed < carried {
+		w.nc = copy(w.carry[:], w.in[consumed:carried])
+		return 0, err
+	}
+	w.nc = 0
+	return consumed - carried, err
+}
+
+// Close writes an incomplete rune at the end of the stream as is. It does not
+// close the underlying writer.
+func (w *Writer) Close() error {
+	if w.nc == 0 {
+		return nil
+	}
+	out, _ := w.m.transform(nil, w.carry[:w.nc], true)
+	w.nc = 0
+	_, err := w.w.Write(out)
+	return err
+}
+
+// limitedWriter accepts only n bytes.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n, _ := w.w.Write(p[:w.n])
+		w.n = 0
+		return n, io.ErrShortWrite
+	}
+	w.n -= len(p)
+	return w.w.Write(p)
+}
+
+// chunkReader returns data in chunks of random size.
+type chunkReader struct {
+	r    io.Reader
+	rand *rand.Rand
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if k := 1 + r.rand.Intn(5); k < len(p) {
+		p = p[:k]
+	}
+	return r.r.Read(p)
+}
+
+// conformance checks readers and writers against the strings package and
+// against mapping the whole string at once.
+func conformance(n int) error {
+	rnd := rand.New(rand.NewSource(1))
+	alphabet := []rune("aBiIıİsßﬁǆǅÄöü€ 🙂'\xff")
+	casers := []Caser{
+		{Case: Upper}, {Case: Lower}, {Case: Title},
+		{Case: Upper, Special: unicode.TurkishCase}, {Case: Lower, Special: unicode.TurkishCase},
+		{Case: Upper, Full: true}, {Case: Title, Full: true},
+	}
+	for i := 0; i < n; i++ {
+		var sb strings.Builder
+		for k := rnd.Intn(12); k > 0; k-- {
+			sb.WriteRune(alphabet[rnd.Intn(len(alphabet))])
+		}
+		s := sb.String()
+		c := casers[rnd.Intn(len(casers))]
+		want := c.String(s)
+		var ref string
+		switch {
+		case c.Case == Upper && c.Special != nil:
+			ref = strings.ToUpperSpecial(c.Special, s)
+		case c.Case == Lower && c.Special != nil:
+			ref = strings.ToLowerSpecial(c.Special, s)
+		case c.Case == Upper && !c.Full:
+			ref = strings.ToUpper(s)
+		case c.Case == Lower && !c.Full:
+			ref = strings.ToLower(s)
+		default:
+			ref = want
+		}
+		if utf8.ValidString(s) && ref != want {
+			return fmt.Errorf("%q with %+v: got %q, strings package says %q", s, c, want, ref)
+		}
+		for _, r := range []io.Reader{
+			iotest.OneByteReader(strings.NewReader(s)),
+			&chunkReader{r: strings.NewReader(s), rand: rnd},
+		} {
+			b, err := ioutil.ReadAll(NewReader(r, c))
+			if err != nil {
+				return err
+			}
+			if string(b) != want {
+				return fmt.Errorf("reader %q with %+v: got %q, want %q", s, c, b, want)
+			}
+		}
+		var buf bytes.Buffer
+		w := NewWriter(&buf, c)
+		if _, err := io.Copy(w, &chunkReader{r: strings.NewReader(s), rand: rnd}); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		if buf.String() != want {
+			return fmt.Errorf("writer %q with %+v: got %q, want %q", s, c, buf.String(), want)
+		}
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "-" {
+		if _, err := io.Copy(os.Stdout, NewReader(os.Stdin, Caser{Case: Upper, Full: true})); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	read := func(s string, c Caser) string {
+		b, err := ioutil.ReadAll(NewReader(iotest.OneByteReader(strings.NewReader(s)), c))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return string(b)
+	}
+	s := "Grüße aus der Straße, ﬁne → fine"
+	fmt.Printf("%-17s%q\n", "upper:", read(s, Caser{Case: Upper, Full: true}))
+	fmt.Printf("%-17s%q\n", "strings.ToUpper:", strings.ToUpper(s))
+	fmt.Printf("%-17s%q\n", "turkish upper:", read("istanbul'da ışık", Caser{Case: Upper, Special: unicode.TurkishCase}))
+	fmt.Printf("%-17s%q\n", "turkish lower:", read("İSTANBUL'DA IŞIK", Caser{Case: Lower, Special: unicode.TurkishCase}))
+	fmt.Printf("%-17s%q\n", "lower:", read("İSTANBUL'DA IŞIK", Caser{Case: Lower, Full: true}))
+	fmt.Printf("%-17s%q\n", "title:", read("hello GOPHERS, o'neil says ǆ is Ǆ, not ǅ", Caser{Case: Title}))
+
+	// Writers report bytes consumed, not bytes written.
+	turkish := Caser{Case: Upper, Special: unicode.TurkishCase}
+	for _, s := range []string{"ıı", "iı"} {
+		var buf bytes.Buffer
+		n, err := NewWriter(&buf, turkish).Write([]byte(s))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("write %q = %d, wrote %q\n", s, n, buf.String())
+	}
+	var buf bytes.Buffer
+	n, err := NewWriter(&limitedWriter{w: &buf, n: 1}, turkish).Write([]byte("ıııı"))
+	fmt.Printf("write %q = %d %v, wrote %q\n", "ıııı", n, err, buf.String())
+
+	if err := conformance(10000); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("10000 random strings, byte by byte and in random chunks: ok")
+}
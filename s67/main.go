@@ -0,0 +1,585 @@
+// S67: One way to write filters: a Transformer.
+//
+// UpperReader (S21), UpperWriter (S23), BlackBar (S27a), Flaky (S44) and
+// finalNewlineReader (S46) all wrap Read or Write by hand. Each gets something
+// wrong at chunk boundaries: a rune or a word split across two reads, a
+// newline added twice, a wrong n.
+//
+// A Transformer only maps bytes from src to dst, like
+// golang.org/x/text/transform. It reports ErrShortDst, when dst is full, and
+// ErrShortSrc, when it needs more input to decide, e.g. the rest of a rune.
+// NewReader and NewWriter take care of buffering, Chain connects transformers.
+//
+// The filters from above are re-expressed as transformers here and checked
+// against the strings package, with input in chunks of random size and with
+// tiny destination buffers. The original programs stay as they are: S21 and
+// S23 are exercises, the others show a single idea each, and a main package
+// cannot import another one.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     ██ █XX WOKE FROM TROUBLED DREAMS, HE FOUND
+//     HIMSELF TRANSFORMED IN HIS BED INTO A HORRIBLE VERMIN.
+//     LAY SPREAD OUT ON THE TABLE - █XX WAS A ██████X - AND
+//     conformance upper: ok
+//     conformance blackbar: ok
+//     conformance final newline: ok
+//     conformance flaky: ok
+//     conformance chain: ok
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	// ErrShortDst means, that dst was too short to receive all output.
+	ErrShortDst = errors.New("transform: short destination buffer")
+	// ErrShortSrc means, that src had insufficient data to complete the
+	// transformation.
+	ErrShortSrc = errors.New("transform: short source buffer")
+
+	errInconsistentByteCount = errors.New("transform: inconsistent byte count returned")
+	errChainStalled          = errors.New("transform: chain made no progress")
+)
+
+// Transformer transforms bytes.
+type Transformer interface {
+	// Transform writes to dst the transformed bytes read from src, and
+	// returns the number of bytes written and read. If it returns nil, all
+	// of src has been consumed. atEOF tells, that src holds the last bytes of
+	// the input.
+	Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error)
+	// Reset resets the state, so the transformer can be used for a new input.
+	Reset()
+}
+
+// NopResetter can be embedded by stateless transformers.
+type NopResetter struct{}
+
+// Reset does nothing.
+func (NopResetter) Reset() {}
+
+const bufSize = 4096
+
+// Reader applies a transformer to what it reads.
+type Reader struct {
+	r   io.Reader
+	t   Transformer
+	err error // error from r
+
+	dst        []byte
+	dst0, dst1 int // transformed, unread bytes
+	src        []byte
+	src0, src1 int // read, untransformed bytes
+
+	complete bool // true, once the transformer has seen the end
+}
+
+// NewReader returns a reader, that transforms the bytes from r.
+func NewReader(r io.Reader, t Transformer) *Reader {
+	t.Reset()
+	return &Reader{r: r, t: t, dst: make([]byte, bufSize), src: make([]byte, bufSize)}
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	for {
+		if r.dst0 != r.dst1 {
+			n := copy(p, r.dst[r.dst0:r.dst1])
+			r.dst0 += n
+			if r.dst0 == r.dst1 && r.complete {
+				return n, r.err
+			}
+			return n, nil
+		}
+		if r.complete {
+			return 0, r.err
+		}
+		if r.src0 != r.src1 || r.err != nil {
+			var n int
+			var err error
+			r.dst0 = 0
+			r.dst1, n, err = r.t.Transform(r.dst, r.src[r.src0:r.src1], r.err == io.EOF)
+			r.src0 += n
+			switch {
+			case err == nil:
+				if r.src0 != r.src1 {
+					r.err = errInconsistentByteCount
+				}
+				// Done, if there is nothing more to read.
+				r.complete = r.err != nil
+				continue
+			case err == ErrShortDst && (r.dst1 != 0 || n != 0):
+				continue // made progress, hand out what we have
+			case err == ErrShortSrc && r.src1-r.src0 != len(r.src) && r.err == nil:
+				// read more below
+			default:
+				r.complete = true
+				if r.err == nil || r.err == io.EOF {
+					r.err = err
+				}
+				continue
+			}
+		}
+		// Move unread bytes to the front and read more.
+		if r.src0 != 0 {
+			r.src0, r.src1 = 0, copy(r.src, r.src[r.src0:r.src1])
+		}
+		var n int
+		n, r.err = r.r.Read(r.src[r.src1:])
+		r.src1 += n
+	}
+}
+
+// Writer applies a transformer to what is written to it. Call Close to
+// flush the end of the stream.
+type Writer struct {
+	w   io.Writer
+	t   Transformer
+	dst []byte
+	src []byte // bytes, the transformer could not consume yet
+}
+
+// NewWriter returns a writer, that transforms bytes before writing them to w.
+func NewWriter(w io.Writer, t Transformer) *Writer {
+	t.Reset()
+	return &Writer{w: w, t: t, dst: make([]byte, bufSize)}
+}
+
+// Write transforms p and writes the result. Bytes, that the transformer
+// cannot consume yet, are kept for the next call, but count as written. On
+// an error, n counts the bytes of p, whose output has been written.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	held := len(w.src)
+	w.src = append(w.src, p...)
+	src := w.src
+	consumed := func() int {
+		if k := len(w.src) - len(src) - held; k > 0 {
+			return k
+		}
+		return 0
+	}
+	for {
+		nDst, nSrc, terr := w.t.Transform(w.dst, src, false)
+		if _, err := w.w.Write(w.dst[:nDst]); err != nil {
+			return consumed(), err
+		}
+		src = src[nSrc:]
+		switch {
+		case terr == ErrShortDst && (nDst > 0 || nSrc > 0):
+			continue
+		case terr == nil && len(src) > 0:
+			return consumed(), errInconsistentByteCount
+		case terr == nil, terr == ErrShortSrc:
+			w.src = append(w.src[:0], src...)
+			return len(p), nil
+		default:
+			return consumed(), terr
+		}
+	}
+}
+
+// Close flushes held bytes and the end of the transformation. It does not
+// close the underlying writer.
+func (w *Writer) Close() error {
+	src := w.src
+	for {
+		nDst, nSrc, err := w.t.Transform(w.dst, src, true)
+		if _, werr := w.w.Write(w.dst[:nDst]); werr != nil {
+			return werr
+		}
+		src = src[nSrc:]
+		if err != ErrShortDst || (nDst == 0 && nSrc == 0) {
+			w.src = w.src[:0]
+			return err
+		}
+	}
+}
+
+// chain connects transformers with intermediate buffers.
+type chain struct {
+	ts    []Transformer
+	links []link // links[i] connects ts[i] and ts[i+1]
+	errs  []error
+	done  []bool
+}
+
+// link is a buffer between two transformers.
+type link struct {
+	b    []byte
+	p, q int // unread bytes are b[p:q]
+}
+
+// Chain returns a transformer, that applies the given transformers in order.
+func Chain(ts ...Transformer) Transformer {
+	c := &chain{ts: ts, errs: make([]error, len(ts)), done: make([]bool, len(ts))}
+	for i := 1; i < len(ts); i++ {
+		c.links = append(c.links, link{b: make([]byte, bufSize)})
+	}
+	return c
+}
+
+// Reset resets all transformers.
+func (c *chain) Reset() {
+	for i, t := range c.ts {
+		t.Reset()
+		c.errs[i], c.done[i] = nil, false
+	}
+	for i := range c.links {
+		c.links[i].p, c.links[i].q = 0, 0
+	}
+}
+
+// Transform runs each transformer in turn, until none makes progress.
+func (c *chain) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if len(c.ts) == 0 {
+		n := copy(dst, src)
+		if n < len(src) {
+			return n, n, ErrShortDst
+		}
+		return n, n, nil
+	}
+	last := len(c.ts) - 1
+	for {
+		progress := false
+		for i, t := range c.ts {
+			var in, out []byte
+			inEOF := atEOF
+			if i == 0 {
+				in = src[nSrc:]
+			} else {
+				l := &c.links[i-1]
+				in, inEOF = l.b[l.p:l.q], c.done[i-1]
+			}
+			if i == last {
+				out = dst[nDst:]
+			} else {
+				l := &c.links[i]
+				if l.p > 0 {
+					l.p, l.q = 0, copy(l.b, l.b[l.p:l.q])
+				}
+				out = l.b[l.q:]
+			}
+			nd, ns, e := t.Transform(out, in, inEOF)
+			if e != nil && e != ErrShortDst && e != ErrShortSrc {
+				return nDst, nSrc, e
+			}
+			if i == 0 {
+				nSrc += ns
+			} else {
+				c.links[i-1].p += ns
+			}
+			if i == last {
+				nDst += nd
+			} else {
+				c.links[i].q += nd
+			}
+			c.errs[i], c.done[i] = e, e == nil && inEOF
+			if nd > 0 || ns > 0 {
+				progress = true
+			}
+		}
+		if progress {
+			continue
+		}
+		switch {
+		case c.done[last]:
+			return nDst, nSrc, nil
+		case c.errs[last] == ErrShortDst:
+			return nDst, nSrc, ErrShortDst
+		case nSrc < len(src):
+			return nDst, nSrc, ErrShortSrc
+		case !atEOF:
+			return nDst, nSrc, nil
+		default:
+			return nDst, nSrc, errChainStalled
+		}
+	}
+}
+
+// upper maps runes to upper case, like UpperReader in S21.
+type upper struct{ NopResetter }
+
+// Upper returns a transformer, that maps letters to upper case.
+func Upper() Transformer { return upper{} }
+
+func (upper) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		if !atEOF && !utf8.FullRune(src[nSrc:]) {
+			return nDst, nSrc, ErrShortSrc
+		}
+		r, size := utf8.DecodeRune(src[nSrc:])
+		r = unicode.ToUpper(r)
+		if utf8.RuneLen(r) > len(dst)-nDst {
+			return nDst, nSrc, ErrShortDst
+		}
+		nDst += utf8.EncodeRune(dst[nDst:], r)
+		nSrc += size
+	}
+	return nDst, nSrc, nil
+}
+
+// blackBar censors words, like BlackBar in S27a.
+type blackBar struct {
+	NopResetter
+	words, bars [][]byte
+}
+
+// bar has the same number of bytes as the word it replaces.
+func bar(w string) string {
+	block := strings.Repeat("█", len(w)/3)
+	switch len(w) % 3 {
+	case 1:
+		block = block + "X"
+	case 2:
+		block = block + "XX"
+	}
+	return block
+}
+
+// BlackBar returns a transformer, that blacks out words. Earlier words take
+// precedence, like with strings.Replacer. Empty words are ignored.
+func BlackBar(words ...string) Transformer {
+	var b blackBar
+	for _, w := range words {
+		if w == "" {
+			continue
+		}
+		b.words = append(b.words, []byte(w))
+		b.bars = append(b.bars, []byte(bar(w)))
+	}
+	return &b
+}
+
+func (b *blackBar) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+outer:
+	for nSrc < len(src) {
+		rest := src[nSrc:]
+		for i, w := range b.words {
+			if bytes.HasPrefix(rest, w) {
+				if len(b.bars[i]) > len(dst)-nDst {
+					return nDst, nSrc, ErrShortDst
+				}
+				nDst += copy(dst[nDst:], b.bars[i])
+				nSrc += len(w)
+				continue outer
+			}
+			if !atEOF && bytes.HasPrefix(w, rest) {
+				return nDst, nSrc, ErrShortSrc // might be this word
+			}
+		}
+		if nDst == len(dst) {
+			return nDst, nSrc, ErrShortDst
+		}
+		dst[nDst] = src[nSrc]
+		nDst++
+		nSrc++
+	}
+	return nDst, nSrc, nil
+}
+
+// finalNewline appends a newline, if missing, like S46.
+type finalNewline struct {
+	last byte
+	any  bool
+}
+
+// FinalNewline returns a transformer, that ensures a final newline. An empty
+// input stays empty.
+func FinalNewline() Transformer { return &finalNewline{} }
+
+func (f *finalNewline) Reset() { *f = finalNewline{} }
+
+func (f *finalNewline) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	n := copy(dst, src)
+	if n > 0 {
+		f.last, f.any = src[n-1], true
+	}
+	if n < len(src) {
+		return n, n, ErrShortDst
+	}
+	if atEOF && f.any && f.last != '\n' {
+		if n == len(dst) {
+			return n, n, ErrShortDst
+		}
+		dst[n] = '\n'
+		f.last = '\n'
+		n++
+	}
+	return n, len(src), nil
+}
+
+// flaky increments bytes with a given probability, like Flaky in S44. One
+// random number is drawn per byte, so the result does not depend on the size
+// of the chunks.
+type flaky struct {
+	prob float64
+	seed int64
+	rand *rand.Rand
+}
+
+// Flaky returns a transformer, that corrupts bytes repeatably.
+func Flaky(prob float64, seed int64) Transformer {
+	return &flaky{prob: prob, seed: seed, rand: rand.New(rand.NewSource(seed))}
+}
+
+func (f *flaky) Reset() { f.rand = rand.New(rand.NewSource(f.seed)) }
+
+func (f *flaky) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	n := copy(dst, src)
+	for i := range dst[:n] {
+		if f.rand.Float64() < f.prob {
+			dst[i]++
+		}
+	}
+	if n < len(src) {
+		return n, n, ErrShortDst
+	}
+	return n, n, nil
+}
+
+// chunkReader returns data in chunks of random size.
+type chunkReader struct {
+	r    io.Reader
+	rand *rand.Rand
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if k := 1 + r.rand.Intn(7); k < len(p) {
+		p = p[:k]
+	}
+	return r.r.Read(p)
+}
+
+// drive calls Transform directly, with chunks of src and dst of random size.
+func drive(t Transformer, s string, rnd *rand.Rand) (string, error) {
+	t.Reset()
+	var out []byte
+	src := []byte(s)
+	var pending []byte // src not consumed
+	for {
+		k := rnd.Intn(8)
+		if k > len(src) {
+			k = len(src)
+		}
+		pending, src = append(pending, src[:k]...), src[k:]
+		atEOF := len(src) == 0
+		dst := make([]byte, 3+rnd.Intn(24)) // large enough for a bar or a rune
+		nDst, nSrc, err := t.Transform(dst, pending, atEOF)
+		out = append(out, dst[:nDst]...)
+		pending = pending[nSrc:]
+		switch {
+		case err == nil && atEOF:
+			return string(out), nil
+		case err == nil, err == ErrShortSrc, err == ErrShortDst:
+		default:
+			return string(out), err
+		}
+	}
+}
+
+// conformance runs a transformer in three ways and compares to a reference.
+func conformance(newT func() Transformer, ref func(string) string) error {
+	rnd := rand.New(rand.NewSource(1))
+	alphabet := []string{"Gre", "gor", "Gregor", " ", "Sam", "sa", "Samsa", "\n", "ß", "ı", "ö", "🙂", "x"}
+	for i := 0; i < 2000; i++ {
+		var sb strings.Builder
+		for k := rnd.Intn(10); k > 0; k-- {
+			sb.WriteString(alphabet[rnd.Intn(len(alphabet))])
+		}
+		s := sb.String()
+		want := ref(s)
+
+		b, err := ioutil.ReadAll(NewReader(&chunkReader{r: strings.NewReader(s), rand: rnd}, newT()))
+		if err != nil || string(b) != want {
+			return fmt.Errorf("reader %q: got %q, %v, want %q", s, b, err, want)
+		}
+		var buf bytes.Buffer
+		w := NewWriter(&buf, newT())
+		if _, err := io.Copy(w, &chunkReader{r: strings.NewReader(s), rand: rnd}); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil || buf.String() != want {
+			return fmt.Errorf("writer %q: got %q, %v, want %q", s, buf.String(), err, want)
+		}
+		got, err := drive(newT(), s, rnd)
+		if err != nil || got != want {
+			return fmt.Errorf("transform %q: got %q, %v, want %q", s, got, err, want)
+		}
+	}
+	return nil
+}
+
+// flakyRef applies the same random sequence to the whole input.
+func flakyRef(prob float64, seed int64) func(string) string {
+	return func(s string) string {
+		rnd := rand.New(rand.NewSource(seed))
+		b := []byte(s)
+		for i := range b {
+			if rnd.Float64() < prob {
+				b[i]++
+			}
+		}
+		return string(b)
+	}
+}
+
+func finalNewlineRef(s string) string {
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		return s + "\n"
+	}
+	return s
+}
+
+var text = `Gregor Samsa woke from troubled dreams, he found
+himself transformed in his bed into a horrible vermin.
+lay spread out on the table - Samsa was a travelling salesman - and`
+
+func main() {
+	// Censor first, then upper case, then make sure, there is a final newline.
+	words := []string{"Gregor", "Samsa", "travelling salesman"}
+	r := NewReader(strings.NewReader(text), Chain(BlackBar(words...), Upper(), FinalNewline()))
+	if _, err := io.Copy(os.Stdout, r); err != nil {
+		log.Fatal(err)
+	}
+
+	words = []string{"Gregor Samsa", "Gregor", "", "Samsa", "Sams"}
+	var pairs []string
+	for _, w := range words {
+		if w != "" {
+			pairs = append(pairs, w, bar(w))
+		}
+	}
+	replacer := strings.NewReplacer(pairs...)
+	for _, c := range []struct {
+		name string
+		newT func() Transformer
+		ref  func(string) string
+	}{
+		{"upper", Upper, strings.ToUpper},
+		{"blackbar", func() Transformer { return BlackBar(words...) }, replacer.Replace},
+		{"final newline", FinalNewline, finalNewlineRef},
+		{"flaky", func() Transformer { return Flaky(0.1, 1) }, flakyRef(0.1, 1)},
+		{"chain",
+			func() Transformer { return Chain(BlackBar(words...), Upper(), Chain(FinalNewline()), Chain()) },
+			func(s string) string { return finalNewlineRef(strings.ToUpper(replacer.Replace(s))) }},
+	} {
+		if err := conformance(c.newT, c.ref); err != nil {
+			log.Fatalf("conformance %s: %v", c.name, err)
+		}
+		fmt.Printf("conformance %s: ok\n", c.name)
+	}
+}
@@ -0,0 +1,528 @@
+// S68: iofilter, a pipeline of readers and writers on the command line.
+//
+// Many examples show a single filter: gzip (S04), base64 (S09), tabwriter
+// (S10), cat -n (S11), upper case (S21), BlackBar (S27a), final newline
+// (S46). Here, each one is a registered stage, and stages are chained on the
+// command line, separated by commas. Stages, that are writers, like gzip, are
+// turned into readers with an io.Pipe. Stages, that map bytes, like upper, are
+// transformers, as in S67, so they never wait for the end of a line.
+//
+// OUTPUT:
+//
+//     $ printf 'Gregor Samsa\nwoke up' | gzip | go run main.go gunzip,upper,redact=GREGOR:SAMSA,number,newline
+//          1	██ █XX
+//          2	WOKE UP
+//
+//     $ printf 'a\tbb\tccc\ndddd\te\tf\n' | go run main.go tabs,base64,newline
+//     YSAgICBiYiBjY2MKZGRkZCBlICBmCg==
+//
+//     $ go run main.go -l
+//     base64      encode to base64
+//     gunzip      decompress gzip
+//     gzip        compress with gzip, arg is the level
+//     lower       map to lower case
+//     newline     add a final newline, if missing
+//     number      number lines, like cat -n
+//     redact      black out words, arg is a colon separated list of words
+//     tabs        align tab separated columns
+//     unbase64    decode base64
+//     upper       map to upper case
+//
+//     $ go run main.go -test
+//     base64      ok
+//     gunzip      ok
+//     gzip        ok
+//     lower       ok
+//     newline     ok
+//     number      ok
+//     redact      ok
+//     tabs        ok
+//     unbase64    ok
+//     upper       ok
+//     pipeline    ok
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	// ErrShortDst means, that dst was too short to receive all output.
+	ErrShortDst = errors.New("transform: short destination buffer")
+	// ErrShortSrc means, that src had insufficient data to complete the
+	// transformation.
+	ErrShortSrc = errors.New("transform: short source buffer")
+
+	errInconsistentByteCount = errors.New("transform: inconsistent byte count returned")
+)
+
+// Stage wraps a reader. The argument is the text after "=", if any.
+type Stage func(r io.Reader, arg string) (io.Reader, error)
+
+type entry struct {
+	help  string
+	stage Stage
+}
+
+var registry = make(map[string]entry)
+
+// Register makes a stage available under a name.
+func Register(name, help string, s Stage) {
+	if _, ok := registry[name]; ok {
+		panic("iofilter: stage registered twice: " + name)
+	}
+	registry[name] = entry{help: help, stage: s}
+}
+
+// Pipeline chains stages given as "name[=arg],name[=arg],...".
+func Pipeline(r io.Reader, spec string) (io.Reader, error) {
+	for _, s := range strings.Split(spec, ",") {
+		name, arg := s, ""
+		if i := strings.Index(s, "="); i >= 0 {
+			name, arg = s[:i], s[i+1:]
+		}
+		e, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown stage: %q", name)
+		}
+		var err error
+		if r, err = e.stage(r, arg); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return r, nil
+}
+
+// fromWriter turns a writing filter into a reader. Errors on either side are
+// passed on to the reader.
+func fromWriter(r io.Reader, wrap func(io.Writer) io.WriteCloser) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		w := wrap(pw)
+		_, err := io.Copy(w, r)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// Transformer transforms bytes.
+type Transformer interface {
+	// Transform writes to dst the transformed bytes read from src, and
+	// returns the number of bytes written and read. If it returns nil, all
+	// of src has been consumed. atEOF tells, that src holds the last bytes of
+	// the input.
+	Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error)
+	// Reset resets the state, so the transformer can be used for a new input.
+	Reset()
+}
+
+// NopResetter can be embedded by stateless transformers.
+type NopResetter struct{}
+
+// Reset does nothing.
+func (NopResetter) Reset() {}
+
+const bufSize = 4096
+
+// Reader applies a transformer to what it reads.
+type Reader struct {
+	r   io.Reader
+	t   Transformer
+	err error // error from r
+
+	dst        []byte
+	dst0, dst1 int // transformed, unread bytes
+	src        []byte
+	src0, src1 int // read, untransformed bytes
+
+	complete bool // true, once the transformer has seen the end
+}
+
+// NewReader returns a reader, that transforms the bytes from r.
+func NewReader(r io.Reader, t Transformer) *Reader {
+	t.Reset()
+	return &Reader{r: r, t: t, dst: make([]byte, bufSize), src: make([]byte, bufSize)}
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	for {
+		if r.dst0 != r.dst1 {
+			n := copy(p, r.dst[r.dst0:r.dst1])
+			r.dst0 += n
+			if r.dst0 == r.dst1 && r.complete {
+				return n, r.err
+			}
+			return n, nil
+		}
+		if r.complete {
+			return 0, r.err
+		}
+		if r.src0 != r.src1 || r.err != nil {
+			var n int
+			var err error
+			r.dst0 = 0
+			r.dst1, n, err = r.t.Transform(r.dst, r.src[r.src0:r.src1], r.err == io.EOF)
+			r.src0 += n
+			switch {
+			case err == nil:
+				if r.src0 != r.src1 {
+					r.err = errInconsistentByteCount
+				}
+				// Done, if there is nothing more to read.
+				r.complete = r.err != nil
+				continue
+			case err == ErrShortDst && (r.dst1 != 0 || n != 0):
+				continue // made progress, hand out what we have
+			case err == ErrShortSrc && r.src1-r.src0 != len(r.src) && r.err == nil:
+				// read more below
+			default:
+				r.complete = true
+				if r.err == nil || r.err == io.EOF {
+					r.err = err
+				}
+				continue
+			}
+		}
+		// Move unread bytes to the front and read more.
+		if r.src0 != 0 {
+			r.src0, r.src1 = 0, copy(r.src, r.src[r.src0:r.src1])
+		}
+		var n int
+		n, r.err = r.r.Read(r.src[r.src1:])
+		r.src1 += n
+	}
+}
+
+// runeMap maps each rune, like Upper in S67.
+type runeMap func(rune) rune
+
+func (runeMap) Reset() {}
+
+func (f runeMap) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		if !atEOF && !utf8.FullRune(src[nSrc:]) {
+			return nDst, nSrc, ErrShortSrc
+		}
+		r, size := utf8.DecodeRune(src[nSrc:])
+		r = f(r)
+		if utf8.RuneLen(r) > len(dst)-nDst {
+			return nDst, nSrc, ErrShortDst
+		}
+		nDst += utf8.EncodeRune(dst[nDst:], r)
+		nSrc += size
+	}
+	return nDst, nSrc, nil
+}
+
+// blackBar censors words, like in S67.
+type blackBar struct {
+	NopResetter
+	words, bars [][]byte
+}
+
+// BlackBar returns a transformer, that blacks out words. Earlier words take
+// precedence. Empty words are ignored.
+func BlackBar(words ...string) Transformer {
+	var t blackBar
+	for _, w := range words {
+		if w == "" {
+			continue
+		}
+		t.words = append(t.words, []byte(w))
+		t.bars = append(t.bars, []byte(bar(w)))
+	}
+	return &t
+}
+
+func (t *blackBar) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+outer:
+	for nSrc < len(src) {
+		rest := src[nSrc:]
+		for i, w := range t.words {
+			if bytes.HasPrefix(rest, w) {
+				if len(t.bars[i]) > len(dst)-nDst {
+					return nDst, nSrc, ErrShortDst
+				}
+				nDst += copy(dst[nDst:], t.bars[i])
+				nSrc += len(w)
+				continue outer
+			}
+			if !atEOF && bytes.HasPrefix(w, rest) {
+				return nDst, nSrc, ErrShortSrc // might be this word
+			}
+		}
+		if nDst == len(dst) {
+			return nDst, nSrc, ErrShortDst
+		}
+		dst[nDst] = src[nSrc]
+		nDst++
+		nSrc++
+	}
+	return nDst, nSrc, nil
+}
+
+// number prefixes each line with its number, like cat -n.
+type number struct {
+	n      int
+	inLine bool // the number of the current line is written
+}
+
+func (t *number) Reset() { *t = number{} }
+
+func (t *number) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		if !t.inLine {
+			prefix := fmt.Sprintf("%6d\t", t.n+1)
+			if len(prefix) > len(dst)-nDst {
+				return nDst, nSrc, ErrShortDst
+			}
+			nDst += copy(dst[nDst:], prefix)
+			t.n, t.inLine = t.n+1, true
+		}
+		if nDst == len(dst) {
+			return nDst, nSrc, ErrShortDst
+		}
+		c := src[nSrc]
+		dst[nDst] = c
+		nDst++
+		nSrc++
+		t.inLine = c != '\n'
+	}
+	return nDst, nSrc, nil
+}
+
+// finalNewline appends a newline, if missing, like S46.
+type finalNewline struct {
+	last byte
+	any  bool
+}
+
+func (t *finalNewline) Reset() { *t = finalNewline{} }
+
+func (t *finalNewline) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	n := copy(dst, src)
+	if n > 0 {
+		t.last, t.any = src[n-1], true
+	}
+	if n < len(src) {
+		return n, n, ErrShortDst
+	}
+	if atEOF && t.any && t.last != '\n' {
+		if n == len(dst) {
+			return n, n, ErrShortDst
+		}
+		dst[n] = '\n'
+		t.last = '\n'
+		n++
+	}
+	return n, len(src), nil
+}
+
+// flushCloser turns a flush into a Close method.
+type flushCloser struct {
+	io.Writer
+	flush func() error
+}
+
+func (f flushCloser) Close() error { return f.flush() }
+
+// bar has the same number of bytes as the word it replaces, like in S27a.
+func bar(w string) string {
+	block := strings.Repeat("█", len(w)/3)
+	switch len(w) % 3 {
+	case 1:
+		block = block + "X"
+	case 2:
+		block = block + "XX"
+	}
+	return block
+}
+
+func init() {
+	Register("gunzip", "decompress gzip", func(r io.Reader, arg string) (io.Reader, error) {
+		return gzip.NewReader(r)
+	})
+	Register("gzip", "compress with gzip, arg is the level", func(r io.Reader, arg string) (io.Reader, error) {
+		level := gzip.DefaultCompression
+		if arg != "" {
+			var err error
+			if level, err = strconv.Atoi(arg); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := gzip.NewWriterLevel(ioutil.Discard, level); err != nil {
+			return nil, err
+		}
+		return fromWriter(r, func(w io.Writer) io.WriteCloser {
+			zw, _ := gzip.NewWriterLevel(w, level)
+			return zw
+		}), nil
+	})
+	Register("base64", "encode to base64", func(r io.Reader, arg string) (io.Reader, error) {
+		return fromWriter(r, func(w io.Writer) io.WriteCloser {
+			return base64.NewEncoder(base64.StdEncoding, w)
+		}), nil
+	})
+	Register("unbase64", "decode base64", func(r io.Reader, arg string) (io.Reader, error) {
+		return base64.NewDecoder(base64.StdEncoding, r), nil
+	})
+	Register("upper", "map to upper case", func(r io.Reader, arg string) (io.Reader, error) {
+		return NewReader(r, runeMap(unicode.ToUpper)), nil
+	})
+	Register("lower", "map to lower case", func(r io.Reader, arg string) (io.Reader, error) {
+		return NewReader(r, runeMap(unicode.ToLower)), nil
+	})
+	Register("redact", "black out words, arg is a colon separated list of words", func(r io.Reader, arg string) (io.Reader, error) {
+		if arg == "" {
+			return nil, fmt.Errorf("missing words")
+		}
+		return NewReader(r, BlackBar(strings.Split(arg, ":")...)), nil
+	})
+	Register("number", "number lines, like cat -n", func(r io.Reader, arg string) (io.Reader, error) {
+		return NewReader(r, &number{}), nil
+	})
+	Register("newline", "add a final newline, if missing", func(r io.Reader, arg string) (io.Reader, error) {
+		return NewReader(r, &finalNewline{}), nil
+	})
+	Register("tabs", "align tab separated columns", func(r io.Reader, arg string) (io.Reader, error) {
+		return fromWriter(r, func(w io.Writer) io.WriteCloser {
+			tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+			return flushCloser{Writer: tw, flush: tw.Flush}
+		}), nil
+	})
+}
+
+// run applies a pipeline to a string.
+func run(spec, s string) (string, error) {
+	r, err := Pipeline(strings.NewReader(s), spec)
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
+
+func gzipped(s string) string {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, s)
+	zw.Close()
+	return buf.String()
+}
+
+// selftest runs each stage at least once and a longer pipeline.
+func selftest() error {
+	text := "Gregor Samsa\nwoke up"
+	cases := []struct {
+		name, spec, in, want string
+	}{
+		{"base64", "base64", "hello", "aGVsbG8="},
+		{"gunzip", "gunzip", gzipped(text), text},
+		{"gzip", "gzip=9,gunzip", text, text},
+		{"lower", "lower", "GrEGor", "gregor"},
+		{"newline", "newline", "a\nb", "a\nb\n"},
+		{"number", "number", "a\nb", "     1\ta\n     2\tb"},
+		{"redact", "redact=Gregor:Samsa", text, "██ █XX\nwoke up"},
+		{"tabs", "tabs", "a\tbb\nccc\td\n", "a   bb\nccc d\n"},
+		{"unbase64", "unbase64", "aGVsbG8=", "hello"},
+		{"upper", "upper", "ölig", "ÖLIG"},
+		{"pipeline", "gzip,base64,unbase64,gunzip,upper,redact=GREGOR,number,newline",
+			text, "     1\t██ SAMSA\n     2\tWOKE UP\n"},
+	}
+	tested := make(map[string]bool)
+	for _, c := range cases {
+		got, err := run(c.spec, c.in)
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.name, err)
+		}
+		if got != c.want {
+			return fmt.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+		fmt.Printf("%-12sok\n", c.name)
+		tested[c.name] = true
+	}
+	for name := range registry {
+		if !tested[name] {
+			return fmt.Errorf("stage without test: %s", name)
+		}
+	}
+	// Errors travel through the pipes.
+	if _, err := run("upper,gunzip", "not gzip"); err == nil {
+		return fmt.Errorf("expected error for invalid input")
+	}
+	if _, err := run("gzip=11", ""); err == nil {
+		return fmt.Errorf("expected error for invalid level")
+	}
+	// Mapping stages do not wait for a newline.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go io.WriteString(pw, "no newline")
+	r, err := Pipeline(pr, "upper,redact=NEWLINE,number")
+	if err != nil {
+		return err
+	}
+	want := "     1\tNO ██X"
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != want {
+		return fmt.Errorf("streaming: got %q, %v, want %q", buf, err, want)
+	}
+	return nil
+}
+
+func main() {
+	list := flag.Bool("l", false, "list stages")
+	test := flag.Bool("test", false, "run self test")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: iofilter [-l] [-test] stage[=arg],...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch {
+	case *list:
+		var names []string
+		for name := range registry {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-12s%s\n", name, registry[name].help)
+		}
+	case *test:
+		if err := selftest(); err != nil {
+			log.Fatal(err)
+		}
+	case flag.NArg() == 1:
+		r, err := Pipeline(bufio.NewReader(os.Stdin), flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := io.Copy(os.Stdout, r); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,300 @@
+// S69: Read compressed or plain input alike.
+//
+// S04 and S17 assume gzip, and S17 ignores the error of gzip.NewReader.
+// Decompress peeks at the first bytes and picks the right decompressor:
+// gzip, also with multiple members, zlib, bzip2, LZW, or no decompression for
+// plain data. Compress writes the same formats, except bzip2, for which the
+// standard library has no writer.
+//
+// Raw flate data has no magic bytes, so it must be asked for explicitly, with
+// NewReader. The zlib header is only two bytes and many pairs of printable
+// characters, like "80" or "Hj", form a valid one. So data is only taken for
+// zlib, if it starts with 0x78, which all common encoders write, uses no
+// preset dictionary and the bytes, that are already buffered, decompress
+// without error. Plain text, that passes all these checks, is still possible,
+// but very unlikely. Detect only waits for the first five bytes, so it works
+// on a stream, that has not ended yet.
+//
+// The compress/lzw package implements the LZW of GIF, TIFF and PDF, not the
+// one of the Unix compress tool. So LZW data gets a small header of its own,
+// and .Z files are recognized, but rejected.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     plain   "Hello, Gopher!\n" <nil>
+//     gzip    "Hello, Gopher!\n" <nil>
+//     zlib    "Hello, Gopher!\n" <nil>
+//     lzw     "Hello, Gopher!\n" <nil>
+//     bzip2   "Hello, bzip2!\n" <nil>
+//     flate   "Hello, Gopher!\n" <nil>
+//     gzip    "first member\nsecond member\n" <nil>
+//     plain   "80,100,120\n" <nil>
+//     plain   "X\ty\n" <nil>
+//     plain   "Hj there\n" <nil>
+//     plain   "x^ hello\n" <nil>
+//     gzip    "Hello, Gopher!\n" unexpected EOF
+//     unix .Z: decompress: unix compress (.Z) is not supported
+//     compress bzip2: compress: bzip2 is not supported
+//     stream  zlib <nil>
+//
+//     $ echo "Hello, Gopher!" | gzip | go run main.go -
+//     Hello, Gopher!
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"compress/lzw"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Format is a compression format.
+type Format int
+
+const (
+	Plain Format = iota
+	Gzip
+	Zlib
+	Flate
+	Bzip2
+	LZW
+	unixCompress
+)
+
+func (f Format) String() string {
+	switch f {
+	case Plain:
+		return "plain"
+	case Gzip:
+		return "gzip"
+	case Zlib:
+		return "zlib"
+	case Flate:
+		return "flate"
+	case Bzip2:
+		return "bzip2"
+	case LZW:
+		return "lzw"
+	case unixCompress:
+		return "unix compress (.Z)"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// lzwMagic starts LZW data written by Compress. The byte after it is the
+// literal width, the order is always LSB.
+var lzwMagic = []byte("LZW\x00")
+
+// ErrUnsupported is returned for formats, that cannot be read or written.
+var ErrUnsupported = errors.New("not supported")
+
+// magicLen is the number of bytes Detect waits for, enough for all magic bytes.
+const magicLen = 5
+
+// isZlib checks the zlib header and tries to decompress the rest of b. Running
+// out of data is fine, corrupt data is not.
+func isZlib(b []byte) bool {
+	if len(b) < 2 || b[0] != 0x78 || b[1]&0x20 != 0 || (uint16(b[0])<<8|uint16(b[1]))%31 != 0 {
+		return false
+	}
+	_, err := io.Copy(ioutil.Discard, flate.NewReader(bytes.NewReader(b[2:])))
+	var ce flate.CorruptInputError
+	return !errors.As(err, &ce)
+}
+
+// Detect sniffs the format of r. The returned reader yields all of r,
+// including the bytes looked at.
+func Detect(r io.Reader) (Format, io.Reader, error) {
+	br := bufio.NewReader(r)
+	b, err := br.Peek(magicLen)
+	if err != nil && err != io.EOF {
+		return Plain, br, err
+	}
+	switch {
+	case len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b:
+		return Gzip, br, nil
+	case len(b) >= 2 && b[0] == 0x1f && b[1] == 0x9d:
+		return unixCompress, br, nil
+	case len(b) >= 4 && b[0] == 'B' && b[1] == 'Z' && b[2] == 'h' && '1' <= b[3] && b[3] <= '9':
+		return Bzip2, br, nil
+	case len(b) >= 5 && bytes.HasPrefix(b, lzwMagic):
+		return LZW, br, nil
+	}
+	// Look at more bytes for zlib, but do not wait for them.
+	if b, _ = br.Peek(br.Buffered()); isZlib(b) {
+		return Zlib, br, nil
+	}
+	return Plain, br, nil
+}
+
+// Decompress detects the format of r and decompresses it.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	f, r, err := Detect(r)
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(r, f)
+}
+
+// NewReader decompresses r, which must be in the given format. Gzip data may
+// consist of several members, which are read one after the other.
+func NewReader(r io.Reader, f Format) (io.ReadCloser, error) {
+	switch f {
+	case Plain:
+		return ioutil.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zlib:
+		return zlib.NewReader(r)
+	case Flate:
+		return flate.NewReader(r), nil
+	case Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case LZW:
+		header := make([]byte, len(lzwMagic)+1)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(header, lzwMagic) {
+			return nil, errors.New("decompress: invalid lzw header")
+		}
+		litWidth := int(header[len(lzwMagic)])
+		if litWidth < 2 || litWidth > 8 {
+			return nil, fmt.Errorf("decompress: invalid lzw literal width %d", litWidth)
+		}
+		return lzw.NewReader(r, lzw.LSB, litWidth), nil
+	}
+	return nil, fmt.Errorf("decompress: %v is %w", f, ErrUnsupported)
+}
+
+// nopWriteCloser adds a no-op Close method.
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Compress returns a writer, that compresses into w. The level is used by
+// gzip, zlib and flate, see compress/flate for values. Close must be called
+// to write the end of the stream; it does not close w.
+func Compress(w io.Writer, f Format, level int) (io.WriteCloser, error) {
+	switch f {
+	case Plain:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriterLevel(w, level)
+	case Zlib:
+		return zlib.NewWriterLevel(w, level)
+	case Flate:
+		return flate.NewWriter(w, level)
+	case LZW:
+		header := append(append([]byte(nil), lzwMagic...), 8)
+		if _, err := w.Write(header); err != nil {
+			return nil, err
+		}
+		return lzw.NewWriter(w, lzw.LSB, 8), nil
+	}
+	return nil, fmt.Errorf("compress: %v is %w", f, ErrUnsupported)
+}
+
+// compress compresses s in a given format.
+func compress(s string, f Format) []byte {
+	var buf bytes.Buffer
+	w, err := Compress(&buf, f, flate.BestCompression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	io.WriteString(w, s)
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// show decompresses data and prints the detected format and the result.
+func show(data []byte) {
+	f, _, err := Detect(bytes.NewReader(data))
+	if err != nil {
+		log.Fatal(err)
+	}
+	rc, err := Decompress(bytes.NewReader(data))
+	if err != nil {
+		fmt.Printf("%-8s%v\n", f, err)
+		return
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	fmt.Printf("%-8s%q %v\n", f, b, err)
+}
+
+// bzipped is "Hello, bzip2!\n", compressed with the bzip2 tool.
+var bzipped = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x04, 0xad, 0x5a, 0x6b, 0x00, 0x00,
+	0x02, 0xdd, 0x80, 0x00, 0x10, 0x60, 0x04, 0x10, 0x00, 0x00, 0x40, 0x12, 0x24, 0xc0, 0x10, 0x20,
+	0x00, 0x22, 0x00, 0x03, 0x42, 0x01, 0xa0, 0x05, 0x67, 0xde, 0x89, 0xa1, 0xa0, 0x80, 0xf1, 0x77,
+	0x24, 0x53, 0x85, 0x09, 0x00, 0x4a, 0xd5, 0xa6, 0xb0,
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "-" {
+		rc, err := Decompress(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer rc.Close()
+		if _, err := io.Copy(os.Stdout, rc); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	const s = "Hello, Gopher!\n"
+	for _, f := range []Format{Plain, Gzip, Zlib, LZW} {
+		show(compress(s, f))
+	}
+	show(bzipped)
+
+	// Raw flate cannot be detected, but read, when asked for.
+	rc, err := NewReader(bytes.NewReader(compress(s, Flate)), Flate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	fmt.Printf("%-8s%q %v\n", Flate, b, err)
+
+	// Concatenated gzip files are one stream, like with zcat.
+	show(append(compress("first member\n", Gzip), compress("second member\n", Gzip)...))
+
+	// Plain text, that starts with a valid zlib header, stays plain.
+	for _, s := range []string{"80,100,120\n", "X\ty\n", "Hj there\n", "x^ hello\n"} {
+		show([]byte(s))
+	}
+
+	// Errors are not ignored.
+	data := compress(s, Gzip)
+	show(data[:len(data)-10])
+
+	_, err = Decompress(bytes.NewReader([]byte{0x1f, 0x9d, 0x90, 'H'}))
+	fmt.Printf("unix .Z: %v\n", err)
+	_, err = Compress(ioutil.Discard, Bzip2, 0)
+	fmt.Printf("compress bzip2: %v\n", err)
+
+	// A stream, that is still being written, is detected, too.
+	pr, pw := io.Pipe()
+	go func() {
+		zw := zlib.NewWriter(pw)
+		io.WriteString(zw, s)
+		zw.Flush()
+	}()
+	f, _, err := Detect(pr)
+	fmt.Printf("stream  %v %v\n", f, err)
+}
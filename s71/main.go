@@ -0,0 +1,443 @@
+// S71: Random access into gzip files.
+//
+// A gzip stream, like gopherbw.png.gz in S17, can only be read from the
+// start. The format here, modeled after BGZF from bioinformatics, cuts the
+// data into blocks of at most 64KB and compresses each block as a gzip member
+// of its own. gzip.NewReader reads multiple members one after the other, so
+// the file is still a valid gzip file.
+//
+// Each member records its compressed size in an extra field of the gzip
+// header, so a reader can hop from member to member without decompressing.
+// The index of block offsets is built that way, or read from a separate index
+// file, like .gzi files of bgzip. The reader then implements io.ReaderAt and
+// io.Seeker over the uncompressed data and decompresses a single block per
+// access.
+//
+// OUTPUT:
+//
+//     $ go run main.go
+//     15888890 bytes in 244 blocks, 2338289 bytes compressed
+//     gzip.NewReader: identical: true
+//     1000 random ReadAt calls: ok
+//     seek to 7777777: "e 493055\nlog line 49"
+//     line at 1000000: "log line 67408\n"
+//     with saved index of 3912 bytes: "e 493055\nlog line 49" <nil>
+//     truncated file: bgzf: index does not match file: entry 122
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// BlockSize is the maximum uncompressed size of a block. It is small
+	// enough, that a compressed block always fits into 64KB.
+	BlockSize = 0xff00
+	// headerSize is the size of a gzip header with our extra field.
+	headerSize = 18
+	// trailerSize is CRC-32 and uncompressed size.
+	trailerSize = 8
+)
+
+// ErrFormat is returned for data, that is not in blocked gzip format.
+var ErrFormat = errors.New("bgzf: invalid block header")
+
+// ErrIndex is returned for an index, that does not fit the file.
+var ErrIndex = errors.New("bgzf: index does not match file")
+
+// Entry locates a block.
+type Entry struct {
+	Offset           int64 // offset of the block in the uncompressed data
+	CompressedOffset int64 // offset of the gzip member in the file
+}
+
+// Writer writes blocked gzip.
+type Writer struct {
+	w     io.Writer
+	buf   []byte
+	out   bytes.Buffer
+	fw    *flate.Writer
+	off   int64 // uncompressed bytes written
+	coff  int64 // compressed bytes written
+	index []Entry
+	err   error
+}
+
+// NewWriter returns a writer with a given compression level.
+func NewWriter(w io.Writer, level int) (*Writer, error) {
+	fw, err := flate.NewWriter(nil, level)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, fw: fw, buf: make([]byte, 0, BlockSize)}, nil
+}
+
+// Write buffers p and writes full blocks.
+func (bw *Writer) Write(p []byte) (n int, err error) {
+	for len(p) > 0 && bw.err == nil {
+		k := copy(bw.buf[len(bw.buf):cap(bw.buf)], p)
+		bw.buf = bw.buf[:len(bw.buf)+k]
+		p = p[k:]
+		n += k
+		if len(bw.buf) == cap(bw.buf) {
+			bw.flush()
+		}
+	}
+	return n, bw.err
+}
+
+// flush writes the buffered data as a gzip member.
+func (bw *Writer) flush() {
+	if bw.err != nil {
+		return
+	}
+	bw.out.Reset()
+	header := []byte{
+		0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 255, // gzip header with FEXTRA
+		6, 0, // XLEN
+		'B', 'C', 2, 0, 0, 0, // subfield with block size - 1, set below
+	}
+	bw.out.Write(header)
+	bw.fw.Reset(&bw.out)
+	if _, bw.err = bw.fw.Write(bw.buf); bw.err != nil {
+		return
+	}
+	if bw.err = bw.fw.Close(); bw.err != nil {
+		return
+	}
+	var trailer [trailerSize]byte
+	binary.LittleEndian.PutUint32(trailer[0:4], crc32.ChecksumIEEE(bw.buf))
+	binary.LittleEndian.PutUint32(trailer[4:8], uint32(len(bw.buf)))
+	bw.out.Write(trailer[:])
+	b := bw.out.Bytes()
+	binary.LittleEndian.PutUint16(b[16:18], uint16(len(b)-1))
+
+	if len(bw.buf) > 0 {
+		bw.index = append(bw.index, Entry{Offset: bw.off, CompressedOffset: bw.coff})
+	}
+	if _, bw.err = bw.w.Write(b); bw.err != nil {
+		return
+	}
+	bw.off += int64(len(bw.buf))
+	bw.coff += int64(len(b))
+	bw.buf = bw.buf[:0]
+}
+
+// Close writes the last block and an empty block, that marks the end of the
+// file. It does not close the underlying writer.
+func (bw *Writer) Close() error {
+	if len(bw.buf) > 0 {
+		bw.flush()
+	}
+	bw.flush()
+	return bw.err
+}
+
+// Index returns the block offsets written so far.
+func (bw *Writer) Index() []Entry {
+	return bw.index
+}
+
+// WriteIndex writes an index: the number of entries, followed by the
+// entries, all as little endian uint64.
+func WriteIndex(w io.Writer, index []Entry) error {
+	bw := bufio.NewWriter(w)
+	binary.Write(bw, binary.LittleEndian, uint64(len(index)))
+	for _, e := range index {
+		binary.Write(bw, binary.LittleEndian, uint64(e.Offset))
+		binary.Write(bw, binary.LittleEndian, uint64(e.CompressedOffset))
+	}
+	return bw.Flush()
+}
+
+// ReadIndex reads an index written by WriteIndex.
+func ReadIndex(r io.Reader) ([]Entry, error) {
+	br := bufio.NewReader(r)
+	var n uint64
+	if err := binary.Read(br, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	var index []Entry
+	for i := uint64(0); i < n; i++ {
+		var off, coff uint64
+		if err := binary.Read(br, binary.LittleEndian, &off); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(br, binary.LittleEndian, &coff); err != nil {
+			return nil, err
+		}
+		index = append(index, Entry{Offset: int64(off), CompressedOffset: int64(coff)})
+	}
+	return index, nil
+}
+
+// BuildIndex hops through the members of a blocked gzip file of the given
+// size. It returns the index and the uncompressed size.
+func BuildIndex(ra io.ReaderAt, size int64) ([]Entry, int64, error) {
+	var (
+		index     []Entry
+		off, coff int64
+		header    [headerSize]byte
+		isize     [4]byte
+	)
+	for coff < size {
+		if _, err := ra.ReadAt(header[:], coff); err != nil {
+			return nil, 0, err
+		}
+		if header[0] != 0x1f || header[1] != 0x8b || header[3]&4 == 0 ||
+			header[10] != 6 || header[12] != 'B' || header[13] != 'C' {
+			return nil, 0, ErrFormat
+		}
+		bsize := int64(binary.LittleEndian.Uint16(header[16:18])) + 1
+		if _, err := ra.ReadAt(isize[:], coff+bsize-4); err != nil {
+			return nil, 0, err
+		}
+		n := int64(binary.LittleEndian.Uint32(isize[:]))
+		if n > 0 {
+			index = append(index, Entry{Offset: off, CompressedOffset: coff})
+		}
+		off += n
+		coff += bsize
+	}
+	return index, off, nil
+}
+
+// Reader gives random access to the uncompressed data of a blocked gzip
+// file. ReadAt may be called concurrently, Read and Seek may not.
+type Reader struct {
+	ra    io.ReaderAt
+	index []Entry
+	size  int64 // uncompressed size
+	off   int64 // for Read and Seek
+
+	mu    sync.Mutex
+	block int // index of cached block, -1 if none
+	data  []byte
+}
+
+// NewReader builds the index by scanning the file.
+func NewReader(ra io.ReaderAt, size int64) (*Reader, error) {
+	index, usize, err := BuildIndex(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{ra: ra, index: index, size: usize, block: -1}, nil
+}
+
+// NewReaderIndex uses an index read with ReadIndex for a file of the given
+// size. It checks, that the blocks are in order and within the file, and only
+// reads the last block to find the uncompressed size.
+func NewReaderIndex(ra io.ReaderAt, size int64, index []Entry) (*Reader, error) {
+	for i, e := range index {
+		if e.CompressedOffset < 0 || e.CompressedOffset+headerSize+trailerSize > size ||
+			(i > 0 && (e.Offset <= index[i-1].Offset || e.CompressedOffset <= index[i-1].CompressedOffset)) {
+			return nil, fmt.Errorf("%w: entry %d", ErrIndex, i)
+		}
+	}
+	r := &Reader{ra: ra, index: index, block: -1}
+	if len(index) > 0 {
+		last := len(index) - 1
+		data, err := r.load(last)
+		if err != nil {
+			return nil, err
+		}
+		r.size = index[last].Offset + int64(len(data))
+	}
+	return r, nil
+}
+
+// Size returns the size of the uncompressed data.
+func (r *Reader) Size() int64 { return r.size }
+
+// load decompresses block i.
+func (r *Reader) load(i int) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.block == i {
+		return r.data, nil
+	}
+	start := r.index[i].CompressedOffset
+	var header [headerSize]byte
+	if _, err := r.ra.ReadAt(header[:], start); err != nil {
+		return nil, err
+	}
+	if header[12] != 'B' || header[13] != 'C' {
+		return nil, ErrFormat
+	}
+	bsize := int64(binary.LittleEndian.Uint16(header[16:18])) + 1
+	zr, err := gzip.NewReader(io.NewSectionReader(r.ra, start, bsize))
+	if err != nil {
+		return nil, err
+	}
+	zr.Multistream(false)
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	r.block, r.data = i, data
+	return data, nil
+}
+
+// ReadAt reads uncompressed data at a given offset.
+func (r *Reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("bgzf: negative offset")
+	}
+	// The last block starting at or before off.
+	i := sort.Search(len(r.index), func(i int) bool { return r.index[i].Offset > off }) - 1
+	for n < len(p) && off < r.size && i >= 0 {
+		data, err := r.load(i)
+		if err != nil {
+			return n, err
+		}
+		k := copy(p[n:], data[off-r.index[i].Offset:])
+		n += k
+		off += int64(k)
+		i++
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read reads from the current offset.
+func (r *Reader) Read(p []byte) (n int, err error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	n, err = r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read, relative to the uncompressed data.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("bgzf: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("bgzf: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func main() {
+	var sb strings.Builder
+	for i := 0; i < 1000000; i++ {
+		fmt.Fprintf(&sb, "log line %d\n", i)
+	}
+	data := sb.String()
+
+	var buf bytes.Buffer
+	bw, err := NewWriter(&buf, gzip.DefaultCompression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := io.WriteString(bw, data); err != nil {
+		log.Fatal(err)
+	}
+	if err := bw.Close(); err != nil {
+		log.Fatal(err)
+	}
+	file := buf.Bytes()
+	fmt.Printf("%d bytes in %d blocks, %d bytes compressed\n", len(data), len(bw.Index()), len(file))
+
+	// Still gzip.
+	zr, err := gzip.NewReader(bytes.NewReader(file))
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("gzip.NewReader: identical: %v\n", string(b) == data)
+
+	r, err := NewReader(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		off := rnd.Int63n(int64(len(data)) + 10)
+		p := make([]byte, rnd.Intn(3*BlockSize))
+		n, err := r.ReadAt(p, off)
+		want := ""
+		if off < int64(len(data)) {
+			want = data[off:]
+		}
+		if len(want) > len(p) {
+			want = want[:len(p)]
+		}
+		if string(p[:n]) != want || (n < len(p)) != (err == io.EOF) {
+			log.Fatalf("ReadAt(%d, %d): got %d bytes, %v", len(p), off, n, err)
+		}
+	}
+	fmt.Println("1000 random ReadAt calls: ok")
+
+	p := make([]byte, 20)
+	if _, err := r.Seek(7777777, io.SeekStart); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := io.ReadFull(r, p); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("seek to 7777777: %q\n", p)
+
+	// Find the first line starting at or after an offset.
+	r.Seek(1000000, io.SeekStart)
+	br := bufio.NewReader(r)
+	br.ReadString('\n')
+	line, err := br.ReadString('\n')
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("line at 1000000: %q\n", line)
+
+	// An index saved next to the file saves the scan.
+	var ibuf bytes.Buffer
+	if err := WriteIndex(&ibuf, bw.Index()); err != nil {
+		log.Fatal(err)
+	}
+	isize := ibuf.Len()
+	index, err := ReadIndex(&ibuf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r, err = NewReaderIndex(bytes.NewReader(file), int64(len(file)), index)
+	if err != nil {
+		log.Fatal(err)
+	}
+	n, err := r.ReadAt(p, 7777777)
+	fmt.Printf("with saved index of %d bytes: %q %v\n", isize, p[:n], err)
+
+	// The index of a truncated file points past its end.
+	_, err = NewReaderIndex(bytes.NewReader(file[:len(file)/2]), int64(len(file)/2), index)
+	fmt.Printf("truncated file: %v\n", err)
+}
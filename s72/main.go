@@ -0,0 +1,279 @@
+// S72: An image converter with options.
+//
+// S05 converts PNG to JPEG at the default quality. Convert reads any image,
+// that image.Decode knows, and writes PNG, JPEG or GIF, with a JPEG quality
+// or a PNG compression level. It can also resize the image, averaging the
+// source pixels under each target pixel, and convert it to grayscale. Like
+// S05, the command reads from standard input and writes to standard output.
+//
+// OUTPUT:
+//
+//     $ cat ../img/bal.jpg | go run main.go -f png -width 100 -gray > bal.png
+//
+//     $ go run main.go -test
+//     ../img/737c.jpg          jpeg  220x142  -> png   220x142  gray=false ok
+//     ../img/737c.jpg          jpeg  220x142  -> png   220x142  gray=true  ok
+//     ../img/737c.jpg          jpeg  220x142  -> jpeg  220x142  gray=false ok
+//     ../img/737c.jpg          jpeg  220x142  -> jpeg   64x41   gray=false ok
+//     ../img/737c.jpg          jpeg  220x142  -> gif    49x32   gray=true  ok
+//     ../img/737c.jpg          jpeg  220x142  -> gif    20x10   gray=false ok
+//     ...
+//     ../img/rr.jpg            jpeg  600x451  -> gif    20x10   gray=false ok
+//
+// The -test flag converts the images in ../img to every format, with and
+// without options, and checks format and size of the result.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Options configure Convert. Zero values select defaults.
+type Options struct {
+	Format  string               // png, jpeg or gif, defaults to the input format
+	Quality int                  // JPEG quality, 1 to 100, defaults to jpeg.DefaultQuality
+	Level   png.CompressionLevel // PNG compression level
+	Width   int                  // target width, 0 keeps the aspect ratio
+	Height  int                  // target height, 0 keeps the aspect ratio
+	Gray    bool                 // convert to grayscale
+}
+
+// ErrFormat is returned for output formats, that are not supported.
+var ErrFormat = errors.New("unsupported output format")
+
+// Convert decodes an image from r, applies the options and encodes it to w.
+// It returns the format of the input.
+func Convert(r io.Reader, w io.Writer, opts Options) (string, error) {
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return "", err
+	}
+	if opts.Format == "" {
+		opts.Format = format
+	}
+	if opts.Width > 0 || opts.Height > 0 {
+		img = Resize(img, opts.Width, opts.Height)
+	}
+	if opts.Gray {
+		img = Gray(img)
+	}
+	return format, Encode(w, img, opts)
+}
+
+// Encode writes an image in the format given in the options.
+func Encode(w io.Writer, img image.Image, opts Options) error {
+	switch strings.ToLower(opts.Format) {
+	case "png":
+		enc := png.Encoder{CompressionLevel: opts.Level}
+		return enc.Encode(w, img)
+	case "jpeg", "jpg":
+		quality := opts.Quality
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		if quality < 1 || quality > 100 {
+			return fmt.Errorf("invalid jpeg quality: %d", quality)
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "gif":
+		// The default palette of gif.Encode has few grays.
+		o := &gif.Options{NumColors: 256}
+		if _, ok := img.(*image.Gray); ok {
+			o.Quantizer = grayQuantizer{}
+		}
+		return gif.Encode(w, img, o)
+	}
+	return fmt.Errorf("%w: %q", ErrFormat, opts.Format)
+}
+
+// grayQuantizer returns a palette of 256 grays.
+type grayQuantizer struct{}
+
+func (grayQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	for i := 0; i < 256; i++ {
+		p = append(p, color.Gray{Y: uint8(i)})
+	}
+	return p
+}
+
+// Resize scales an image to a given width and height. If one of them is zero,
+// it is chosen to keep the aspect ratio. Each target pixel is the average of
+// the source pixels it covers.
+func Resize(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if sw == 0 || sh == 0 {
+		return img
+	}
+	switch {
+	case width <= 0 && height <= 0:
+		return img
+	case width <= 0:
+		width = max(1, sw*height/sh)
+	case height <= 0:
+		height = max(1, sh*width/sw)
+	}
+	dst := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*sh/height
+		y1 := max(y0+1, b.Min.Y+(y+1)*sh/height)
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*sw/width
+			x1 := max(x0+1, b.Min.X+(x+1)*sw/width)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+// Gray converts an image to grayscale.
+func Gray(img image.Image) image.Image {
+	if g, ok := img.(*image.Gray); ok {
+		return g
+	}
+	b := img.Bounds()
+	dst := image.NewGray(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(x, y, img.At(x, y))
+		}
+	}
+	return dst
+}
+
+// selftest converts each image to each format and checks the results.
+func selftest(pattern string) error {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no images found: %s", pattern)
+	}
+	cases := []Options{
+		{Format: "png"},
+		{Format: "png", Level: png.BestSpeed, Gray: true},
+		{Format: "jpeg", Quality: 50},
+		{Format: "jpeg", Width: 64},
+		{Format: "gif", Height: 32, Gray: true},
+		{Format: "gif", Width: 20, Height: 10},
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		for _, opts := range cases {
+			var buf bytes.Buffer
+			format, err := Convert(bytes.NewReader(data), &buf, opts)
+			if err != nil {
+				return fmt.Errorf("%s: %+v: %v", file, opts, err)
+			}
+			img, got, err := image.Decode(&buf)
+			if err != nil {
+				return fmt.Errorf("%s: %+v: cannot decode result: %v", file, opts, err)
+			}
+			w, h := cfg.Width, cfg.Height
+			switch {
+			case opts.Width > 0 && opts.Height > 0:
+				w, h = opts.Width, opts.Height
+			case opts.Width > 0:
+				w, h = opts.Width, max(1, h*opts.Width/w)
+			case opts.Height > 0:
+				w, h = max(1, w*opts.Height/h), opts.Height
+			}
+			if got != opts.Format || img.Bounds().Dx() != w || img.Bounds().Dy() != h {
+				return fmt.Errorf("%s: %+v: got %s %v", file, opts, got, img.Bounds())
+			}
+			if opts.Gray && !isGray(img) {
+				return fmt.Errorf("%s: %+v: not gray", file, opts)
+			}
+			fmt.Printf("%-24s %-4s %4dx%-4d -> %-4s %4dx%-4d gray=%-5v ok\n", file, format,
+				cfg.Width, cfg.Height, got, w, h, opts.Gray)
+		}
+	}
+	if _, err := Convert(strings.NewReader("not an image"), ioutil.Discard, Options{}); err == nil {
+		return errors.New("expected error for invalid input")
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	if _, err := Convert(bytes.NewReader(data), ioutil.Discard, Options{Format: "bmp"}); !errors.Is(err, ErrFormat) {
+		return fmt.Errorf("expected ErrFormat, got %v", err)
+	}
+	return nil
+}
+
+// isGray reports whether all pixels have equal red, green and blue values.
+func isGray(img image.Image) bool {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			if r>>8 != g>>8 || g>>8 != bl>>8 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func main() {
+	var opts Options
+	level := flag.String("level", "default", "png compression: default, none, speed or best")
+	flag.StringVar(&opts.Format, "f", "", "output format: png, jpeg or gif, defaults to the input format")
+	flag.IntVar(&opts.Quality, "q", jpeg.DefaultQuality, "jpeg quality, 1 to 100")
+	flag.IntVar(&opts.Width, "width", 0, "resize to width, 0 keeps the aspect ratio")
+	flag.IntVar(&opts.Height, "height", 0, "resize to height, 0 keeps the aspect ratio")
+	flag.BoolVar(&opts.Gray, "gray", false, "convert to grayscale")
+	test := flag.Bool("test", false, "convert the images in ../img and check the results")
+	flag.Parse()
+
+	if *test {
+		if err := selftest("../img/*"); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	levels := map[string]png.CompressionLevel{
+		"default": png.DefaultCompression,
+		"none":    png.NoCompression,
+		"speed":   png.BestSpeed,
+		"best":    png.BestCompression,
+	}
+	l, ok := levels[*level]
+	if !ok {
+		log.Fatalf("invalid png compression level: %s", *level)
+	}
+	opts.Level = l
+	if _, err := Convert(os.Stdin, os.Stdout, opts); err != nil {
+		log.Fatal(err)
+	}
+}